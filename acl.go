@@ -28,6 +28,8 @@ import (
 type ACLDefinitions struct {
 	ConnectPorts    map[int][]string
 	ContentTypes    map[string][]string
+	FileTypes       map[string][]string
+	FileExtensions  map[string][]string
 	Methods         map[string][]string
 	Referers        map[string][]string
 	StatusCodes     map[int][]string
@@ -37,6 +39,10 @@ type ACLDefinitions struct {
 	UserNames       map[string][]string
 	ServerIPs       IPMap
 	JA3Fingerprints map[string][]string
+	JA4Fingerprints map[string][]string
+	TLSVersions     map[string][]string
+	ECH             []string
+	PostQuantum     []string
 
 	// ExternalDeviceGroups is a cache of the device groups returned by the
 	// authenticator-api endpoint.
@@ -53,9 +59,14 @@ type ACLDefinitions struct {
 		acl    string
 	}
 
+	Headers         []headerACL
+	ResponseHeaders []headerACL
+
 	Descriptions map[string]string
 
 	Actions []ACLActionRule
+
+	Quotas []QuotaRule
 }
 
 var errEmptyACLRule = errors.New("empty ACL rule")
@@ -90,6 +101,24 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			a.ContentTypes[ct] = append(a.ContentTypes[ct], acl)
 		}
 
+	case "file-type":
+		if a.FileTypes == nil {
+			a.FileTypes = make(map[string][]string)
+		}
+		for _, t := range args {
+			t = strings.ToLower(t)
+			a.FileTypes[t] = append(a.FileTypes[t], acl)
+		}
+
+	case "file-extension":
+		if a.FileExtensions == nil {
+			a.FileExtensions = make(map[string][]string)
+		}
+		for _, ext := range args {
+			ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+			a.FileExtensions[ext] = append(a.FileExtensions[ext], acl)
+		}
+
 	case "ja3":
 		if a.JA3Fingerprints == nil {
 			a.JA3Fingerprints = make(map[string][]string)
@@ -98,6 +127,34 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			a.JA3Fingerprints[ja3] = append(a.JA3Fingerprints[ja3], acl)
 		}
 
+	case "ja4":
+		if a.JA4Fingerprints == nil {
+			a.JA4Fingerprints = make(map[string][]string)
+		}
+		for _, ja4 := range args {
+			a.JA4Fingerprints[ja4] = append(a.JA4Fingerprints[ja4], acl)
+		}
+
+	case "tls-version":
+		if a.TLSVersions == nil {
+			a.TLSVersions = make(map[string][]string)
+		}
+		for _, arg := range args {
+			v := strings.TrimPrefix(strings.ToLower(arg), "tls")
+			switch v {
+			case "1.0", "1.1", "1.2", "1.3", "ssl3":
+			default:
+				return fmt.Errorf("unknown TLS version: %s", arg)
+			}
+			a.TLSVersions[v] = append(a.TLSVersions[v], acl)
+		}
+
+	case "ech":
+		a.ECH = append(a.ECH, acl)
+
+	case "post-quantum":
+		a.PostQuantum = append(a.PostQuantum, acl)
+
 	case "method":
 		if a.Methods == nil {
 			a.Methods = make(map[string][]string)
@@ -126,6 +183,48 @@ func (a *ACLDefinitions) AddRule(acl string, newRule []string) error {
 			}
 		}
 
+	case "header", "response-header":
+		if len(args) < 2 {
+			return fmt.Errorf("%s ACL needs a header name and a regular expression", keyword)
+		}
+		h, err := newHeaderACL(args[0], strings.Join(args[1:], " "), acl)
+		if err != nil {
+			return err
+		}
+		if keyword == "header" {
+			a.Headers = append(a.Headers, h)
+		} else {
+			a.ResponseHeaders = append(a.ResponseHeaders, h)
+		}
+
+	case "server-country":
+		for _, country := range args {
+			if err := a.ServerIPs.addCountry(country, acl); err != nil {
+				return err
+			}
+		}
+
+	case "server-asn":
+		for _, asn := range args {
+			if err := a.ServerIPs.addASN(asn, acl); err != nil {
+				return err
+			}
+		}
+
+	case "user-country":
+		for _, country := range args {
+			if err := a.UserIPs.addCountry(country, acl); err != nil {
+				return err
+			}
+		}
+
+	case "user-asn":
+		for _, asn := range args {
+			if err := a.UserIPs.addASN(asn, acl); err != nil {
+				return err
+			}
+		}
+
 	case "http-status":
 		if a.StatusCodes == nil {
 			a.StatusCodes = make(map[int][]string)
@@ -255,6 +354,15 @@ func (a *ACLDefinitions) load(filename string) error {
 			}
 			a.Descriptions[args[0]] = strings.Join(args[1:], " ")
 
+		case "quota":
+			// Define a daily time budget.
+			q, err := parseQuotaRule(args)
+			if err != nil {
+				log.Printf("Error at %s, line %d: %v", filename, lineNo, err)
+				continue
+			}
+			a.Quotas = append(a.Quotas, q)
+
 		case "include":
 			for _, file := range args {
 				if !filepath.IsAbs(file) {
@@ -266,7 +374,7 @@ func (a *ACLDefinitions) load(filename string) error {
 				}
 			}
 
-		case "allow", "block", "block-invisible", "censor-words", "disable-proxy-headers", "hash-image", "ignore-category", "log-content", "phrase-scan", "require-auth", "ssl-bump", "virus-scan":
+		case "allow", "block", "block-invisible", "block-upload", "bypass-cache", "censor-words", "disable-proxy-headers", "hash-image", "icap-reqmod", "icap-respmod", "ignore-category", "log-content", "phrase-scan", "require-auth", "ssl-bump", "strip-ech", "virus-scan":
 			r := ACLActionRule{Action: action}
 		argLoop:
 			for _, a := range args {
@@ -339,10 +447,8 @@ func (a *ACLDefinitions) requestACLs(r *http.Request, user string) map[string]bo
 	}
 
 	now := time.Now()
-	day := now.Weekday()
-	h, m, _ := now.Clock()
 	for _, t := range a.Times {
-		if t.schedule.Contains(day, h, m) {
+		if t.schedule.Matches(now) {
 			acls[t.acl] = true
 		}
 	}
@@ -366,11 +472,13 @@ func (a *ACLDefinitions) requestACLs(r *http.Request, user string) map[string]bo
 		}
 	}
 
-	server := r.URL.Host
-	if host, _, err := net.SplitHostPort(server); err == nil {
-		server = host
+	var serverIPs []net.IP
+	if rs := resolvedServerFromContext(r.Context()); rs != nil && rs.appliesTo(hostOnly(r.URL.Host)) {
+		serverIPs = rs.IPs
+	} else if ip := net.ParseIP(hostOnly(r.URL.Host)); ip != nil {
+		serverIPs = []net.IP{ip}
 	}
-	if ip := net.ParseIP(server); ip != nil {
+	for _, ip := range serverIPs {
 		for _, acl := range a.ServerIPs.matches(ip) {
 			acls[acl] = true
 		}
@@ -384,12 +492,41 @@ func (a *ACLDefinitions) requestACLs(r *http.Request, user string) map[string]bo
 		}
 	}
 
+	for _, h := range a.Headers {
+		if h.matches(r.Header) {
+			acls[h.acl] = true
+		}
+	}
+
 	if tlsFingerprint, ok := r.Context().Value(tlsFingerprintKey{}).(string); ok {
 		for _, acl := range a.JA3Fingerprints[tlsFingerprint] {
 			acls[acl] = true
 		}
 	}
 
+	if hello, ok := r.Context().Value(clientHelloKey{}).(*clientHelloInfo); ok {
+		if len(a.JA4Fingerprints) > 0 {
+			for _, acl := range a.JA4Fingerprints[hello.JA4()] {
+				acls[acl] = true
+			}
+		}
+		for _, v := range hello.TLSVersions() {
+			for _, acl := range a.TLSVersions[v] {
+				acls[acl] = true
+			}
+		}
+		if hello.ECH {
+			for _, acl := range a.ECH {
+				acls[acl] = true
+			}
+		}
+		if hello.PostQuantum() {
+			for _, acl := range a.PostQuantum {
+				acls[acl] = true
+			}
+		}
+	}
+
 	return acls
 }
 
@@ -431,6 +568,12 @@ func (a *ACLDefinitions) responseACLs(resp *http.Response) map[string]bool {
 		}
 	}
 
+	if a.inspectsDownloads() {
+		for acl := range a.downloadACLs(resp) {
+			acls[acl] = true
+		}
+	}
+
 	status := resp.StatusCode
 	for _, acl := range a.StatusCodes[status] {
 		acls[acl] = true
@@ -441,9 +584,46 @@ func (a *ACLDefinitions) responseACLs(resp *http.Response) map[string]bool {
 		acls[acl] = true
 	}
 
+	for _, h := range a.ResponseHeaders {
+		if h.matches(resp.Header) {
+			acls[h.acl] = true
+		}
+	}
+
 	return acls
 }
 
+// A headerACL assigns an ACL to messages that have a header matching a
+// regular expression.
+type headerACL struct {
+	name   string
+	regexp *regexp.Regexp
+	acl    string
+}
+
+func newHeaderACL(name, exp, acl string) (headerACL, error) {
+	r, err := regexp.Compile("(?i)" + exp)
+	if err != nil {
+		return headerACL{}, err
+	}
+	return headerACL{
+		name:   http.CanonicalHeaderKey(name),
+		regexp: r,
+		acl:    acl,
+	}, nil
+}
+
+// matches returns whether any of the values of the header in h match the
+// regular expression. If the header is not present, it never matches.
+func (ha headerACL) matches(h http.Header) bool {
+	for _, v := range h.Values(ha.name) {
+		if ha.regexp.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
 // An ACLActionRule specifies an action that will be performed if a request
 // belongs to a certain set of ACLs.
 type ACLActionRule struct {
@@ -16,6 +16,10 @@ func init() {
 	apiServeMux.HandleFunc("/classify-text", handleClassifyText)
 	apiServeMux.HandleFunc("/classify-text/verbose", handleClassifyText)
 
+	apiServeMux.HandleFunc("/quotas", handleQuotaStatus)
+	apiServeMux.HandleFunc("/pinning", handlePinningList)
+	apiServeMux.HandleFunc("/connection-stats", handleConnectionStats)
+
 	apiServeMux.HandleFunc("/per-user-ports", handlePerUserPortList)
 	apiServeMux.HandleFunc("/per-user-ports/authenticate", handlePerUserAuthenticate)
 }
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A shared HTTP cache (RFC 9111), stored on disk.
+//
+// The cache stores responses as they come from the server, before any
+// filtering. Responses that come from the cache still go through the
+// response ACLs, phrase scanning, etc., so blocked content is never served
+// from it, even when the same page is allowed for some users and blocked for
+// others.
+
+// maxHeuristicFreshness is the longest that a response without explicit
+// freshness information is considered fresh.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// A cacheEntry is a stored response.
+type cacheEntry struct {
+	// ID is the hash of the URL and the request headers that the response
+	// varies on. It is used to name the files the entry is stored in.
+	ID string
+
+	URL string
+
+	// VaryValues holds the request's values for the headers listed in the
+	// response's Vary header.
+	VaryValues map[string]string
+
+	StatusCode int
+	Header     http.Header
+
+	// RequestTime and ResponseTime are when the request that produced the
+	// response was sent, and when the response was received (or last
+	// revalidated).
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	Size int64
+
+	element *list.Element
+}
+
+// An httpCache is a disk-backed response cache. It persists across
+// configuration reloads.
+type httpCache struct {
+	lock sync.Mutex
+
+	dir           string
+	maxSize       int64
+	maxObjectSize int64
+
+	size int64
+
+	// entries maps from URL to the variants stored for it.
+	entries map[string][]*cacheEntry
+
+	// lru lists the entries, most recently used first.
+	lru *list.List
+}
+
+var responseCache = &httpCache{
+	entries: make(map[string][]*cacheEntry),
+	lru:     list.New(),
+}
+
+// Open sets the directory where the cache is stored, and its size limits.
+// If dir is different from the previous directory, the entries stored in
+// dir are loaded. If dir is empty, caching is disabled.
+func (c *httpCache) Open(dir string, maxSize, maxObjectSize int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxSize = maxSize
+	c.maxObjectSize = maxObjectSize
+	if dir == c.dir {
+		c.evict()
+		return
+	}
+
+	c.dir = dir
+	c.size = 0
+	c.entries = make(map[string][]*cacheEntry)
+	c.lru = list.New()
+	if dir == "" {
+		return
+	}
+
+	tmpDir := filepath.Join(dir, "tmp")
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		log.Printf("Error creating cache directory %s: %v", tmpDir, err)
+		c.dir = ""
+		return
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*", "*.meta"))
+	if err != nil {
+		log.Printf("Error listing cache directory %s: %v", dir, err)
+	}
+	var loaded []*cacheEntry
+	for _, f := range metaFiles {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		e := new(cacheEntry)
+		if err := json.Unmarshal(data, e); err != nil || e.ID+".meta" != filepath.Base(f) {
+			os.Remove(f)
+			continue
+		}
+		if fi, err := os.Stat(c.bodyPath(e.ID)); err != nil || fi.Size() != e.Size {
+			os.Remove(f)
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	for _, e := range loaded {
+		c.add(e)
+	}
+	// The entries were loaded in arbitrary order, so the least recently
+	// used ones can't be identified; this just keeps the size in bounds.
+	c.evict()
+	log.Printf("Loaded %d responses (%d MB) from cache in %s", len(loaded), c.size>>20, dir)
+}
+
+func (c *httpCache) enabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dir != ""
+}
+
+func (c *httpCache) metaPath(id string) string {
+	return filepath.Join(c.dir, id[:2], id+".meta")
+}
+
+func (c *httpCache) bodyPath(id string) string {
+	return filepath.Join(c.dir, id[:2], id+".body")
+}
+
+// add puts e in the index. c.lock must be held.
+func (c *httpCache) add(e *cacheEntry) {
+	variants := c.entries[e.URL]
+	for i, v := range variants {
+		if v.ID == e.ID {
+			c.size -= v.Size
+			c.lru.Remove(v.element)
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	c.entries[e.URL] = append(variants, e)
+	e.element = c.lru.PushFront(e)
+	c.size += e.Size
+}
+
+// remove deletes e from the index and the disk. c.lock must be held.
+func (c *httpCache) remove(e *cacheEntry) {
+	variants := c.entries[e.URL]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.URL)
+	} else {
+		c.entries[e.URL] = variants
+	}
+	c.lru.Remove(e.element)
+	c.size -= e.Size
+	os.Remove(c.metaPath(e.ID))
+	os.Remove(c.bodyPath(e.ID))
+}
+
+// evict removes the least recently used entries until the cache is no
+// larger than its maximum size. c.lock must be held.
+func (c *httpCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// invalidate removes all the stored responses for url.
+func (c *httpCache) invalidate(url string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range append([]*cacheEntry(nil), c.entries[url]...) {
+		c.remove(e)
+	}
+}
+
+// lookup returns the stored response for req, or nil if there is none.
+func (c *httpCache) lookup(req *http.Request) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, e := range c.entries[req.URL.String()] {
+		if e.matches(req) {
+			c.lru.MoveToFront(e.element)
+			copied := *e
+			copied.Header = e.Header.Clone()
+			return &copied
+		}
+	}
+	return nil
+}
+
+// matches returns whether req has the same values as the request e was
+// stored for, in the headers that e varies on.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, value := range e.VaryValues {
+		if strings.Join(req.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// store saves e, with the body that has been written to the temporary file
+// tmpName.
+func (c *httpCache) store(e *cacheEntry, tmpName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dir == "" || !strings.HasPrefix(tmpName, c.dir) {
+		// The cache was disabled or moved.
+		os.Remove(tmpName)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.bodyPath(e.ID)), 0755); err != nil {
+		log.Printf("Error creating cache directory: %v", err)
+		os.Remove(tmpName)
+		return
+	}
+	if err := os.Rename(tmpName, c.bodyPath(e.ID)); err != nil {
+		log.Printf("Error storing cached response: %v", err)
+		os.Remove(tmpName)
+		return
+	}
+	if err := c.writeMeta(e); err != nil {
+		log.Printf("Error storing cached response: %v", err)
+		os.Remove(c.bodyPath(e.ID))
+		return
+	}
+	c.add(e)
+	c.evict()
+}
+
+// writeMeta saves e's metadata. c.lock must be held.
+func (c *httpCache) writeMeta(e *cacheEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.metaPath(e.ID), data, 0644)
+}
+
+// refresh updates the stored entry with the same ID as e, after e has been
+// revalidated.
+func (c *httpCache) refresh(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, v := range c.entries[e.URL] {
+		if v.ID == e.ID {
+			v.Header = e.Header.Clone()
+			v.RequestTime = e.RequestTime
+			v.ResponseTime = e.ResponseTime
+			if err := c.writeMeta(v); err != nil {
+				log.Printf("Error updating cached response: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// cacheControl parses the Cache-Control headers in h. The keys are the
+// directive names, in lowercase.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+// seconds parses a delta-seconds value.
+func seconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// date returns the value of the Date header, or the response time if it is
+// missing or invalid.
+func (e *cacheEntry) date() time.Time {
+	if d, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return d
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime returns how long the response is fresh for, counting
+// from when it was generated.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := cacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if d, ok := seconds(cc["s-maxage"]); ok {
+		return d
+	}
+	if d, ok := seconds(cc["max-age"]); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires header means that the response is already
+			// stale.
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+
+	// Heuristic freshness: 10% of the time since the resource was last
+	// modified.
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		d := e.date().Sub(lm) / 10
+		if d > maxHeuristicFreshness {
+			d = maxHeuristicFreshness
+		}
+		if d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// currentAge calculates the age of the response (RFC 9111, section 4.2.3).
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := seconds(e.Header.Get("Age"))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// hasValidators returns whether the response can be revalidated with a
+// conditional request.
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// cacheableStatus lists the status codes that are stored.
+var cacheableStatus = map[int]bool{
+	200: true,
+	203: true,
+	300: true,
+	301: true,
+	308: true,
+	404: true,
+	410: true,
+}
+
+// transport returns an http.RoundTripper that uses the cache, and sends
+// requests that can't be answered from the cache to rt. If bypass is true,
+// the cache is not used (but the status is still recorded for the access
+// log).
+func (c *httpCache) transport(rt http.RoundTripper, bypass bool) http.RoundTripper {
+	return cachingTransport{cache: c, rt: rt, bypass: bypass}
+}
+
+type cachingTransport struct {
+	cache  *httpCache
+	rt     http.RoundTripper
+	bypass bool
+}
+
+// cacheStatusHeader is the response header that records whether the
+// response came from the cache, for the access log. It is internal to
+// Redwood, and is not sent to clients (see copyResponseHeader).
+const cacheStatusHeader = "X-Redwood-Cache"
+
+func (t cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.bypass {
+		return t.forward(req, "BYPASS")
+	}
+
+	switch req.Method {
+	case "GET":
+	case "HEAD", "OPTIONS", "TRACE":
+		return t.forward(req, "")
+	default:
+		// Unsafe methods invalidate the stored responses for the URL.
+		resp, err := t.forward(req, "")
+		if err == nil && resp.StatusCode < 400 {
+			t.cache.invalidate(req.URL.String())
+		}
+		return resp, err
+	}
+
+	reqCC := cacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok || req.Header.Get("Range") != "" {
+		return t.forward(req, "")
+	}
+
+	noCache := strings.Contains(req.Header.Get("Pragma"), "no-cache")
+	if _, ok := reqCC["no-cache"]; ok {
+		noCache = true
+	}
+
+	now := time.Now()
+	e := t.cache.lookup(req)
+	if e != nil && !noCache {
+		age := e.currentAge(now)
+		fresh := age < e.freshnessLifetime()
+		if maxAge, ok := seconds(reqCC["max-age"]); ok && age > maxAge {
+			fresh = false
+		}
+		if fresh {
+			if resp, err := t.cache.response(e, req, now); err == nil {
+				resp.Header.Set(cacheStatusHeader, "HIT")
+				return resp, nil
+			}
+		}
+	}
+
+	if e != nil && e.hasValidators() {
+		// Revalidate the stored response.
+		cr := req.Clone(req.Context())
+		for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+			cr.Header.Del(h)
+		}
+		if etag := e.Header.Get("ETag"); etag != "" {
+			cr.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			cr.Header.Set("If-Modified-Since", lm)
+		}
+
+		requestTime := time.Now()
+		resp, err := t.rt.RoundTrip(cr)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			Lce(resp.Body.Close())
+			for k, v := range resp.Header {
+				switch k {
+				case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+					continue
+				}
+				e.Header[k] = v
+			}
+			removeHopByHopHeaders(e.Header)
+			e.RequestTime = requestTime
+			e.ResponseTime = time.Now()
+			t.cache.refresh(e)
+			if resp, err := t.cache.response(e, req, time.Now()); err == nil {
+				resp.Header.Set(cacheStatusHeader, "REVALIDATED")
+				return resp, nil
+			}
+			// The stored body is gone, so fetch the response again.
+			return t.fetch(req, time.Now())
+		}
+		resp.Request = req
+		return t.cache.maybeStore(req, resp, requestTime), nil
+	}
+
+	return t.fetch(req, now)
+}
+
+// forward sends req to the underlying transport without using the cache.
+func (t cachingTransport) forward(req *http.Request, status string) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del(cacheStatusHeader)
+	if status != "" {
+		resp.Header.Set(cacheStatusHeader, status)
+	}
+	return resp, nil
+}
+
+// fetch sends req to the underlying transport, and stores the response
+// if possible.
+func (t cachingTransport) fetch(req *http.Request, requestTime time.Time) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.cache.maybeStore(req, resp, requestTime), nil
+}
+
+// response makes an HTTP response from e, using the stored body.
+func (c *httpCache) response(e *cacheEntry, req *http.Request, now time.Time) (*http.Response, error) {
+	c.lock.Lock()
+	path := c.bodyPath(e.ID)
+	c.lock.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.currentAge(now)/time.Second), 10))
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          f,
+		ContentLength: e.Size,
+		Request:       req,
+	}, nil
+}
+
+// maybeStore checks whether resp can be stored in the cache. If so, it
+// arranges for the body to be saved as it is read. It returns resp, with
+// the cache status set.
+func (c *httpCache) maybeStore(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	resp.Header.Del(cacheStatusHeader)
+	resp.Header.Set(cacheStatusHeader, "MISS")
+
+	if !cacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" {
+		return resp
+	}
+	cc := cacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return resp
+	}
+	if _, ok := cc["private"]; ok {
+		return resp
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return resp
+		}
+	}
+
+	c.lock.Lock()
+	dir, maxObjectSize := c.dir, c.maxObjectSize
+	c.lock.Unlock()
+	if dir == "" || resp.ContentLength > maxObjectSize {
+		return resp
+	}
+
+	e := &cacheEntry{
+		URL:          req.URL.String(),
+		VaryValues:   make(map[string]string),
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	e.Header.Del(cacheStatusHeader)
+	removeHopByHopHeaders(e.Header)
+
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return resp
+			}
+			if name != "" {
+				e.VaryValues[name] = strings.Join(req.Header.Values(name), ", ")
+			}
+		}
+	}
+
+	if e.freshnessLifetime() <= 0 && !e.hasValidators() {
+		// It would never be used.
+		return resp
+	}
+
+	h := sha256.New()
+	io.WriteString(h, e.URL)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			io.WriteString(h, "\n"+name+": "+e.VaryValues[name])
+		}
+	}
+	e.ID = hex.EncodeToString(h.Sum(nil))
+
+	tmp, err := os.CreateTemp(filepath.Join(dir, "tmp"), e.ID[:16]+"-*")
+	if err != nil {
+		log.Printf("Error creating temporary file for cache: %v", err)
+		return resp
+	}
+
+	resp.Body = &cacheWriter{
+		ReadCloser:    resp.Body,
+		cache:         c,
+		entry:         e,
+		tmp:           tmp,
+		maxObjectSize: maxObjectSize,
+	}
+	return resp
+}
+
+// A cacheWriter saves a response body to a temporary file as it is read.
+// If the whole body is read, it is added to the cache.
+type cacheWriter struct {
+	io.ReadCloser
+	cache         *httpCache
+	entry         *cacheEntry
+	tmp           *os.File
+	maxObjectSize int64
+	done          bool
+}
+
+func (w *cacheWriter) Read(p []byte) (n int, err error) {
+	n, err = w.ReadCloser.Read(p)
+	if w.done {
+		return n, err
+	}
+	if n > 0 {
+		if w.entry.Size+int64(n) > w.maxObjectSize {
+			w.discard()
+		} else if _, werr := w.tmp.Write(p[:n]); werr != nil {
+			log.Printf("Error writing to cache: %v", werr)
+			w.discard()
+		} else {
+			w.entry.Size += int64(n)
+		}
+	}
+	switch {
+	case w.done:
+	case err == io.EOF:
+		w.done = true
+		if cerr := w.tmp.Close(); cerr != nil {
+			os.Remove(w.tmp.Name())
+			break
+		}
+		w.cache.store(w.entry, w.tmp.Name())
+	case err != nil:
+		w.discard()
+	}
+	return n, err
+}
+
+func (w *cacheWriter) discard() {
+	w.done = true
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (w *cacheWriter) Close() error {
+	if !w.done {
+		// The body wasn't read to the end, so it is incomplete.
+		w.discard()
+	}
+	return w.ReadCloser.Close()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// iCalendar (.ics) files of holidays and term dates, for time-based ACLs
+
+// A calendarEvent is a period of time during which an event is in progress.
+// All-day events are stored with floating times, so that they cover the whole
+// day in whatever time zone the schedule is evaluated in.
+type calendarEvent struct {
+	Start, End time.Time
+	Floating   bool
+}
+
+func (e calendarEvent) Contains(t time.Time) bool {
+	if e.Floating {
+		// Reinterpret t's wall-clock time as UTC, to match how the floating
+		// times were stored.
+		y, mo, d := t.Date()
+		h, mi, s := t.Clock()
+		t = time.Date(y, mo, d, h, mi, s, 0, time.UTC)
+	}
+	return !t.Before(e.Start) && t.Before(e.End)
+}
+
+// An icsCalendar is the set of events in an iCalendar file. The file is
+// re-read when it changes, so that term dates and holidays can be updated
+// without reloading the configuration.
+type icsCalendar struct {
+	path string
+
+	lock      sync.Mutex
+	events    []calendarEvent
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+var (
+	icsCalendars     = map[string]*icsCalendar{}
+	icsCalendarsLock sync.Mutex
+)
+
+// loadICSCalendar returns the calendar for the file at path, sharing it with
+// other schedules that use the same file.
+func loadICSCalendar(path string) *icsCalendar {
+	icsCalendarsLock.Lock()
+	defer icsCalendarsLock.Unlock()
+
+	c := icsCalendars[path]
+	if c == nil {
+		c = &icsCalendar{path: path}
+		icsCalendars[path] = c
+	}
+	c.lock.Lock()
+	c.refresh(true)
+	c.lock.Unlock()
+	return c
+}
+
+// refresh re-reads the calendar file if it has been modified. Unless force
+// is true, it checks at most once a minute. c.lock must be held.
+func (c *icsCalendar) refresh(force bool) {
+	now := time.Now()
+	if !force && now.Sub(c.lastCheck) < time.Minute {
+		return
+	}
+	c.lastCheck = now
+
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		log.Printf("Error checking calendar file %s: %v", c.path, err)
+		return
+	}
+	if fi.ModTime().Equal(c.modTime) {
+		return
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		log.Printf("Error opening calendar file %s: %v", c.path, err)
+		return
+	}
+	defer f.Close()
+
+	events, err := parseICS(f)
+	if err != nil {
+		log.Printf("Error parsing calendar file %s: %v", c.path, err)
+		return
+	}
+	c.events = events
+	c.modTime = fi.ModTime()
+}
+
+// Contains returns whether any of c's events is in progress at time t.
+func (c *icsCalendar) Contains(t time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refresh(false)
+
+	for _, e := range c.events {
+		if e.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseICS reads the VEVENT components from an iCalendar file. Only the
+// DTSTART, DTEND, and DURATION properties are used; recurrence rules are
+// not supported.
+func parseICS(r io.Reader) ([]calendarEvent, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			// A folded continuation line.
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []calendarEvent
+	inEvent := false
+	var start, end icsTime
+	var duration time.Duration
+	var haveEnd, haveDuration bool
+
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		nameAndParams, value := line[:colon], line[colon+1:]
+		params := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(params[0])
+		params = params[1:]
+
+		switch name {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent = true
+				start, end = icsTime{}, icsTime{}
+				duration, haveEnd, haveDuration = 0, false, false
+			}
+
+		case "END":
+			if !strings.EqualFold(value, "VEVENT") || !inEvent {
+				continue
+			}
+			inEvent = false
+			if start.t.IsZero() {
+				continue
+			}
+			e := calendarEvent{Start: start.t, Floating: start.floating}
+			switch {
+			case haveEnd:
+				e.End = end.t
+			case haveDuration:
+				e.End = start.t.Add(duration)
+			case start.dateOnly:
+				e.End = start.t.AddDate(0, 0, 1)
+			default:
+				e.End = start.t
+			}
+			events = append(events, e)
+
+		case "DTSTART", "DTEND":
+			if !inEvent {
+				continue
+			}
+			t, err := parseICSTime(value, params)
+			if err != nil {
+				return nil, err
+			}
+			if name == "DTSTART" {
+				start = t
+			} else {
+				end = t
+				haveEnd = true
+			}
+
+		case "DURATION":
+			if !inEvent {
+				continue
+			}
+			d, err := parseICSDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			duration = d
+			haveDuration = true
+		}
+	}
+
+	return events, nil
+}
+
+// An icsTime is a DATE or DATE-TIME value from an iCalendar file.
+type icsTime struct {
+	t        time.Time
+	dateOnly bool
+	floating bool
+}
+
+func parseICSTime(value string, params []string) (icsTime, error) {
+	var loc *time.Location
+	for _, p := range params {
+		eq := strings.Index(p, "=")
+		if eq == -1 {
+			continue
+		}
+		switch strings.ToUpper(p[:eq]) {
+		case "TZID":
+			l, err := time.LoadLocation(strings.Trim(p[eq+1:], `"`))
+			if err != nil {
+				return icsTime{}, err
+			}
+			loc = l
+		}
+	}
+
+	if len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return icsTime{}, fmt.Errorf("invalid date %q", value)
+		}
+		return icsTime{t: t, dateOnly: true, floating: true}, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return icsTime{}, fmt.Errorf("invalid date-time %q", value)
+		}
+		return icsTime{t: t}, nil
+	}
+
+	if loc != nil {
+		t, err := time.ParseInLocation("20060102T150405", value, loc)
+		if err != nil {
+			return icsTime{}, fmt.Errorf("invalid date-time %q", value)
+		}
+		return icsTime{t: t}, nil
+	}
+
+	t, err := time.Parse("20060102T150405", value)
+	if err != nil {
+		return icsTime{}, fmt.Errorf("invalid date-time %q", value)
+	}
+	return icsTime{t: t, floating: true}, nil
+}
+
+// parseICSDuration parses an iCalendar duration such as P1D, PT2H30M, or P2W.
+func parseICSDuration(s string) (time.Duration, error) {
+	orig := s
+	negative := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		negative = true
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", orig)
+	}
+	s = s[1:]
+
+	var d time.Duration
+	inTime := false
+	n := 0
+	haveDigits := false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + int(c-'0')
+			haveDigits = true
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		if !haveDigits {
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", orig)
+		}
+		n = 0
+		haveDigits = false
+	}
+
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
@@ -3,7 +3,9 @@ package main
 // storage and loading of categories
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"fmt"
 	"github.com/tharow-services/redwood/efs"
 	"log"
@@ -198,11 +200,62 @@ func loadCategory(dirname string, parent *category) (c *category, err error) {
 // collectRules collects the rules from all the categories and adds
 // them to URLRules and phraseRules.
 func (conf *config) collectRules() {
+	standalonePhrases := make(map[string]bool)
+	conf.Combinations = make(map[rule]combination)
+	conf.CombinationPhrases = make(map[string]bool)
+	conf.CombinationOnlyPhrases = make(map[string]bool)
+	conf.NormalizedPhrases = make(map[string][]string)
+	conf.SubstringPhrases = make(map[string][]string)
+
+	// The phrases go in the segmentation dictionary first, so that they are
+	// segmented the same way as the page content will be.
+	conf.SegmentWords = nil
+	for _, c := range conf.Categories {
+		for rule := range c.weights {
+			switch rule.t {
+			case contentPhrase:
+				conf.addSegmentWords(rule.content)
+			case combinationRule:
+				for _, p := range splitCombination(rule.content).phrases {
+					conf.addSegmentWords(p)
+				}
+			}
+		}
+	}
+
 	for _, c := range conf.Categories {
 		for rule := range c.weights {
 			switch rule.t {
 			case contentPhrase:
-				conf.ContentPhraseList.addPhrase(rule.content)
+				// The phrase list gets the normalized and segmented form,
+				// and NormalizedPhrases maps it back to the rule.
+				p := conf.phraseForm(rule.content)
+				if !stringIn(rule.content, conf.NormalizedPhrases[p]) {
+					conf.NormalizedPhrases[p] = append(conf.NormalizedPhrases[p], rule.content)
+				}
+				conf.ContentPhraseList.addPhrase(p)
+				standalonePhrases[p] = true
+			case contentSubstring:
+				p := rule.content
+				if conf.NormalizeText {
+					p = conf.normalizePhrase(p)
+				}
+				if !stringIn(rule.content, conf.SubstringPhrases[p]) {
+					conf.SubstringPhrases[p] = append(conf.SubstringPhrases[p], rule.content)
+				}
+				conf.SubstringPhraseList.addPhrase(p)
+			case combinationRule:
+				comb := splitCombination(rule.content)
+				for i, p := range comb.phrases {
+					comb.phrases[i] = conf.phraseForm(p)
+				}
+				conf.Combinations[rule] = comb
+				for _, p := range comb.phrases {
+					conf.ContentPhraseList.addPhrase(p)
+					conf.CombinationPhrases[p] = true
+				}
+			case contentRegex:
+				conf.ContentRegexes.addRule(rule)
 			case imageHash:
 				content := rule.content
 				threshold := -1
@@ -221,12 +274,39 @@ func (conf *config) collectRules() {
 					continue
 				}
 				conf.ImageHashes = append(conf.ImageHashes, dhashWithThreshold{h, threshold})
+			case fileHash:
+				if b, err := hex.DecodeString(rule.content); err != nil || len(b) != sha256.Size {
+					log.Printf("%v: invalid SHA-256 hash", rule)
+					continue
+				}
+				if conf.FileHashes == nil {
+					conf.FileHashes = make(map[string]bool)
+				}
+				conf.FileHashes[rule.content] = true
+				if c.action == ALLOW {
+					if conf.AllowedHashes == nil {
+						conf.AllowedHashes = make(map[string]bool)
+					}
+					conf.AllowedHashes[rule.content] = true
+				}
+			case dataPatternMatch:
+				// Data patterns are matched by scanUpload.
 			default:
 				conf.URLRules.AddRule(rule)
 			}
 		}
 	}
+	for p := range conf.CombinationPhrases {
+		if !standalonePhrases[p] {
+			conf.CombinationOnlyPhrases[p] = true
+		}
+	}
+	if len(conf.FileHashes) > 0 && conf.MaxHashSize <= 0 {
+		log.Println("Warning: there are sha256 rules, but they won't match anything unless max-hash-size is set.")
+	}
 	conf.ContentPhraseList.findFallbackNodes(0, nil)
+	conf.SubstringPhraseList.findFallbackNodes(0, nil)
+	conf.ContentRegexes.stringList.findFallbackNodes(0, nil)
 	conf.URLRules.finalize()
 }
 
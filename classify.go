@@ -24,6 +24,10 @@ type classificationResponse struct {
 	Rules      map[string]int `json:"rules,omitempty"`
 	Error      string         `json:"error,omitempty"`
 	LogLine    []string       `json:"logLine,omitempty"`
+
+	// MatchedText is the original text of words that were changed by
+	// normalize-text before they matched phrase rules.
+	MatchedText map[string][]string `json:"matchedText,omitempty"`
 }
 
 // handleClassification responds to an HTTP request with a url parameter, and
@@ -32,6 +36,7 @@ func handleClassification(w http.ResponseWriter, r *http.Request) {
 	conf := getConfig()
 
 	var result classificationResponse
+	verbose := r.URL.Path == "/classify/verbose"
 
 	url := r.FormValue("url")
 	result.URL = url
@@ -101,7 +106,12 @@ func handleClassification(w http.ResponseWriter, r *http.Request) {
 			modified = conf.pruneContent(req.URL, &content, cs, &doc)
 		}
 
-		conf.scanContent(content, contentType, cs, tally)
+		var changed map[string][]string
+		if verbose {
+			changed = make(map[string][]string)
+		}
+		conf.scanContentWithChanges(content, contentType, cs, tally, changed)
+		result.MatchedText = conf.matchedText(tally, changed)
 		scoresNeedUpdate = true
 
 	case "hash-image":
@@ -138,7 +148,7 @@ func handleClassification(w http.ResponseWriter, r *http.Request) {
 
 	result.Categories = scores
 	logLine := logAccess(req, resp, int64(len(content)), modified, "", tally, scores, ACLActionRule{Action: "classify"}, "", nil)
-	if r.URL.Path == "/classify/verbose" {
+	if verbose {
 		result.LogLine = logLine
 	}
 	ServeJSON(w, r, result)
@@ -158,8 +168,14 @@ func handleClassifyText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	verbose := r.URL.Path == "/classify-text/verbose"
+
 	tally := make(map[rule]int)
-	conf.scanContent([]byte(text), "text/plain", "utf-8", tally)
+	var changed map[string][]string
+	if verbose {
+		changed = make(map[string][]string)
+	}
+	conf.scanContentWithChanges([]byte(text), "text/plain", "utf-8", tally, changed)
 	scores := conf.categoryScores(tally)
 
 	for _, c := range conf.ClassifierIgnoredCategories {
@@ -167,11 +183,12 @@ func handleClassifyText(w http.ResponseWriter, r *http.Request) {
 	}
 	result.Categories = scores
 
-	if r.URL.Path == "/classify-text/verbose" {
+	if verbose {
 		result.Rules = make(map[string]int)
 		for r, n := range tally {
 			result.Rules[r.String()] = n
 		}
+		result.MatchedText = conf.matchedText(tally, changed)
 	}
 
 	ServeJSON(w, r, result)
@@ -0,0 +1,221 @@
+package main
+
+// Combination rules, which match when all of a set of content phrases occur
+// on a page (optionally within a certain number of words of each other).
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPhrasePositions is the most occurrences of each phrase that are
+// recorded for evaluating combination rules.
+const maxPhrasePositions = 10000
+
+// A combination is a parsed combination rule.
+type combination struct {
+	phrases []string
+
+	// near is the maximum distance (in words) between the phrases, or 0 if
+	// they can be anywhere on the page.
+	near int
+}
+
+// parseCombination parses a combination rule (like <a>,<b>~10) from the
+// beginning of s.
+func parseCombination(s string) (r rule, leftover string, err error) {
+	var phrases []string
+	for {
+		if !strings.HasPrefix(s, "<") {
+			return rule{}, s, errors.New("expected '<' in combination")
+		}
+		end := strings.Index(s, ">")
+		if end == -1 {
+			return rule{}, s, errors.New("unmatched '<'")
+		}
+		phrases = append(phrases, wordString(s[1:end]))
+		s = s[end+1:]
+		if !strings.HasPrefix(s, ",<") {
+			break
+		}
+		s = s[1:]
+	}
+
+	r.t = combinationRule
+	r.content = "<" + strings.Join(phrases, ">,<") + ">"
+
+	if strings.HasPrefix(s, "~") {
+		digits := len(s[1:]) - len(strings.TrimLeft(s[1:], "0123456789"))
+		near, err := strconv.Atoi(s[1 : 1+digits])
+		if err != nil || near <= 0 {
+			return rule{}, s, errors.New("invalid distance after '~' in combination")
+		}
+		r.content += "~" + strconv.Itoa(near)
+		s = s[1+digits:]
+	}
+
+	return r, s, nil
+}
+
+// splitCombination splits the content of a combination rule into its
+// phrases and distance.
+func splitCombination(content string) combination {
+	var c combination
+	if tilde := strings.LastIndex(content, ">~"); tilde != -1 {
+		c.near, _ = strconv.Atoi(content[tilde+2:])
+		content = content[:tilde+1]
+	}
+	content = strings.TrimSuffix(strings.TrimPrefix(content, "<"), ">")
+	c.phrases = strings.Split(content, ">,<")
+	return c
+}
+
+// matches returns whether the combination occurs, given the positions of
+// the phrases on the page.
+func (c combination) matches(positions map[string][]int) bool {
+	for _, p := range c.phrases {
+		if len(positions[p]) == 0 {
+			return false
+		}
+	}
+	if c.near == 0 {
+		return true
+	}
+
+	// Look for a window of c.near words that contains all the phrases.
+	type occurrence struct {
+		pos    int
+		phrase int
+	}
+	var occurrences []occurrence
+	for i, p := range c.phrases {
+		for _, pos := range positions[p] {
+			occurrences = append(occurrences, occurrence{pos, i})
+		}
+	}
+	sort.Slice(occurrences, func(i, j int) bool {
+		return occurrences[i].pos < occurrences[j].pos
+	})
+
+	counts := make([]int, len(c.phrases))
+	found := 0
+	start := 0
+	for _, o := range occurrences {
+		if counts[o.phrase] == 0 {
+			found++
+		}
+		counts[o.phrase]++
+		for occurrences[start].pos < o.pos-c.near {
+			counts[occurrences[start].phrase]--
+			if counts[occurrences[start].phrase] == 0 {
+				found--
+			}
+			start++
+		}
+		if found == len(c.phrases) {
+			return true
+		}
+	}
+	return false
+}
+
+// A contentScanner scans page content for content phrases, and keeps track
+// of where the phrases that are part of combination rules occur, so that
+// the combinations can be checked at the end.
+type contentScanner struct {
+	ps    *phraseScanner
+	conf  *config
+	tally map[rule]int
+
+	// words is the number of word breaks scanned so far.
+	words     int
+	positions map[string][]int
+
+	// substrings scans for substring phrases, which see the text before
+	// it is segmented.
+	substrings *phraseScanner
+
+	// run is text in segmented scripts that hasn't been split into words
+	// yet, partial is an incomplete UTF-8 sequence, and prev is the last
+	// byte passed to the phrase scanner.
+	run     []byte
+	partial []byte
+	prev    byte
+}
+
+// newContentScanner returns a contentScanner that adds the rules it finds to
+// tally.
+func (conf *config) newContentScanner(tally map[rule]int) *contentScanner {
+	cs := &contentScanner{
+		conf:  conf,
+		tally: tally,
+	}
+	cs.ps = newPhraseScanner(conf.ContentPhraseList, func(p string) {
+		if conf.CombinationPhrases[p] {
+			if cs.positions == nil {
+				cs.positions = make(map[string][]int)
+			}
+			if len(cs.positions[p]) < maxPhrasePositions {
+				// The position is the number of word breaks before the
+				// start of the phrase.
+				cs.positions[p] = append(cs.positions[p], cs.words-strings.Count(strings.TrimLeft(p, " "), " "))
+			}
+			if conf.CombinationOnlyPhrases[p] {
+				return
+			}
+		}
+		if originals, ok := conf.NormalizedPhrases[p]; ok {
+			for _, o := range originals {
+				tally[rule{t: contentPhrase, content: o}]++
+			}
+			return
+		}
+		tally[rule{t: contentPhrase, content: p}]++
+	})
+	if len(conf.SubstringPhraseList) > 1 {
+		cs.substrings = newPhraseScanner(conf.SubstringPhraseList, func(p string) {
+			for _, o := range conf.SubstringPhrases[p] {
+				tally[rule{t: contentSubstring, content: o}]++
+			}
+		})
+	}
+	return cs
+}
+
+func (cs *contentScanner) scanByte(c byte) {
+	if cs.substrings != nil {
+		cs.substrings.scanByte(c)
+	}
+	if c < utf8.RuneSelf && len(cs.run) == 0 && len(cs.partial) == 0 {
+		cs.scanWordByte(c)
+		return
+	}
+	cs.segmentByte(c)
+}
+
+// scanWordByte passes a byte of segmented text to the phrase scanner.
+func (cs *contentScanner) scanWordByte(c byte) {
+	if c == ' ' {
+		cs.words++
+	}
+	cs.prev = c
+	cs.ps.scanByte(c)
+}
+
+// finish checks the combination rules, and adds the ones that matched to
+// the tally.
+func (cs *contentScanner) finish() {
+	cs.flushRun()
+	if cs.positions == nil {
+		return
+	}
+	for r, c := range cs.conf.Combinations {
+		if c.matches(cs.positions) {
+			cs.tally[r] = 1
+		}
+	}
+	cs.positions = nil
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/andybalholm/dhash"
+	"github.com/oschwald/maxminddb-golang"
 )
 
 type dhashWithThreshold struct {
@@ -48,15 +49,60 @@ type config struct {
 	Categories         map[string]*category
 	BuiltInCategories  []string
 	ContentPhraseList  phraseList
+	ContentRegexes     *regexMap
+	Combinations       map[rule]combination
 	CountOnce          bool
 	Threshold          int
 	URLRules           *URLMatcher
 	MaxContentScanSize int
+	StreamScan         bool
+	StreamScanWindow   int
 	PublicSuffixes     []string
 
+	MaxDownloadInspectSize int
+	ArchiveDepth           int
+
+	GeoIPCountryDB *maxminddb.Reader
+	GeoIPASNDB     *maxminddb.Reader
+
+	// CombinationPhrases is the set of phrases that are part of
+	// combination rules, and CombinationOnlyPhrases is the ones that aren't
+	// also rules by themselves.
+	CombinationPhrases     map[string]bool
+	CombinationOnlyPhrases map[string]bool
+
+	// NormalizeText turns on normalization of page text before phrase
+	// scanning. NormalizedPhrases maps the form of each content phrase
+	// that is in ContentPhraseList (normalized and segmented) to the
+	// phrases it came from.
+	NormalizeText     bool
+	LeetMap           map[rune]rune
+	NormalizedPhrases map[string][]string
+
+	// SegmentWords is the dictionary for splitting text in languages like
+	// Chinese into words: the built-in word lists, plus the content
+	// phrases.
+	SegmentWords *segmentDictionary
+
+	// SubstringPhraseList holds the content phrases that match anywhere,
+	// even in the middle of words in languages that are segmented, and
+	// SubstringPhrases maps them to the phrases they came from.
+	SubstringPhraseList phraseList
+	SubstringPhrases    map[string][]string
+
 	ImageHashes    []dhashWithThreshold
 	DhashThreshold int
 
+	FileHashes  map[string]bool
+	MaxHashSize int
+
+	// AllowedHashes is the set of file hashes that are in categories
+	// whose action is allow.
+	AllowedHashes map[string]bool
+
+	DataPatterns      []dataPattern
+	MaxUploadScanSize int
+
 	ACLs    ACLDefinitions
 	APIACLs ACLDefinitions
 
@@ -66,6 +112,10 @@ type config struct {
 
 	ProxyAddresses       []string
 	TransparentAddresses []string
+	DNSProxyAddresses    []string
+	SOCKSAddresses       []string
+	ICAPAddresses        []string
+	DNSUpstream          string
 
 	ClassifierIgnoredCategories []string
 
@@ -108,9 +158,11 @@ type config struct {
 	ContentLogDir string
 	Verbose       map[string]bool
 
-	CloseIdleConnections time.Duration
-	HTTP2Upstream        bool
-	HTTP2Downstream      bool
+	CloseIdleConnections      time.Duration
+	HTTP2Upstream             bool
+	HTTP2Downstream           bool
+	MaxConnectionsPerHost     int
+	MaxIdleConnectionsPerHost int
 
 	ExternalClassifiers []string
 
@@ -119,6 +171,25 @@ type config struct {
 
 	ClassLinkSettingsFile string
 
+	QuotaFile  string
+	QuotaReset int
+
+	PinningFile      string
+	PinningThreshold int
+	PinningClients   int
+
+	ParentProxies           []parentProxyRule
+	ParentProxyPinAddresses bool
+
+	ICAPServices []*icapService
+
+	CacheDir           string
+	CacheSize          int
+	MaxCacheObjectSize int
+
+	SquidHelper   string
+	SquidBlockURL string
+
 	StarlarkScripts   []string
 	StarlarkFunctions map[string][]starlarkFunction
 	StarlarkLog       string
@@ -145,6 +216,8 @@ func loadConfiguration() (*config, error) {
 		VirtualHosts:         map[string]string{},
 		ServeMux:             http.NewServeMux(),
 		ContentPhraseList:    newPhraseList(),
+		SubstringPhraseList:  newPhraseList(),
+		ContentRegexes:       newRegexMap(),
 		Passwords:            map[string]string{},
 		CustomPorts:          map[string]customPortInfo{},
 		UserForPort:          map[int]string{},
@@ -157,6 +230,7 @@ func loadConfiguration() (*config, error) {
 	c.newActiveFlag("api-acls", "", "ACL rule file for API requests", c.APIACLs.load)
 	c.newActiveFlag("authenticator", "", "program to authenticate users", c.addAuthenticator)
 	c.newActiveFlag("authenticator-api", "", "HTTP API endpoint to authenticate users", c.addHTTPAuthenticator)
+	c.flags.IntVar(&c.ArchiveDepth, "archive-depth", 3, "how many levels of nested archives to list the contents of, for file-type and file-extension ACLs")
 	c.flags.StringVar(&c.AuthRealm, "auth-realm", "Redwood", "realm name for authentication prompts")
 	c.flags.BoolVar(&c.BlockObsoleteSSL, "block-obsolete-ssl", false, "block SSL connections with protocol version too old to filter")
 	c.flags.BoolVar(&c.ConfigProxy, "config-proxy", false, "configure windows proxy settings on start up")
@@ -172,26 +246,58 @@ func loadConfiguration() (*config, error) {
 	c.newActiveFlag("content-pruning", "", "path to config file for content pruning", c.loadPruningConfig)
 	c.flags.BoolVar(&c.CountOnce, "count-once", false, "count each phrase only once per page")
 	c.flags.IntVar(&c.DhashThreshold, "dhash-threshold", 0, "how many bits can be different in an image's hash to match")
+	c.newActiveFlag("data-pattern", "", "named regular expression to look for in uploads (for pattern: rules)", c.addDataPattern)
 	c.newActiveFlag("error-page", "", "path to template for error page, or URL of dynamic error page", c.loadErrorPage)
+	c.newActiveFlag("geoip-asn-db", "", "path to MaxMind DB file of autonomous system numbers", c.loadGeoIPASNDB)
+	c.newActiveFlag("geoip-country-db", "", "path to MaxMind DB file of countries", c.loadGeoIPCountryDB)
 	c.flags.IntVar(&c.GZIPLevel, "gzip-level", 6, "level to use for gzip compression of content")
+	c.flags.StringVar(&c.CacheDir, "cache-dir", "", "directory to store cached responses in (if empty, responses are not cached)")
+	c.flags.IntVar(&c.CacheSize, "cache-size", 1024, "maximum size (in megabytes) of the response cache")
 	c.flags.BoolVar(&c.HTTP2Downstream, "http2-downstream", true, "Use HTTP/2 for connections to clients.")
 	c.flags.BoolVar(&c.HTTP2Upstream, "http2-upstream", true, "Use HTTP/2 for connections to upstream servers.")
+	c.newActiveFlag("icap-service", "", "ICAP server to send requests or responses to (reqmod or respmod, followed by an icap:// URL, and optionally bypass)", c.addICAPService)
 	c.newActiveFlag("include", "", "additional config file to read", c.readConfigFile)
 	c.newActiveFlag("ip-to-user", "", "map of IP addresses to user names", c.loadIPToUser)
+	c.newActiveFlag("leet-map", "", "characters to treat as letters when normalize-text is on (like 0=o 1=i 3=e)", c.parseLeetMap)
 	c.flags.BoolVar(&c.LogTitle, "log-title", false, "Include page title in access log.")
 	c.flags.BoolVar(&c.LogUserAgent, "log-user-agent", false, "Include User-Agent header in access log.")
+	c.flags.IntVar(&c.MaxCacheObjectSize, "max-cache-object-size", 50e6, "maximum size (in bytes) of a response to store in the cache")
+	c.flags.IntVar(&c.MaxConnectionsPerHost, "max-connections-per-host", 0, "maximum number of connections to each upstream server (0 for no limit)")
+	c.flags.IntVar(&c.MaxIdleConnectionsPerHost, "max-idle-connections-per-host", 8, "maximum number of idle connections to keep open to each upstream server (0 to disable keep-alives)")
+	c.flags.IntVar(&c.MaxHashSize, "max-hash-size", 0, "maximum size (in bytes) of a response to calculate the SHA-256 hash of (0 to disable hashing)")
+	c.flags.IntVar(&c.MaxDownloadInspectSize, "max-download-inspect-size", 10e6, "maximum size (in bytes) of download to buffer for file-type and file-extension ACLs")
 	c.flags.IntVar(&c.MaxContentScanSize, "max-content-scan-size", 1e6, "maximum size (in bytes) of page to do content scan on")
+	c.flags.IntVar(&c.MaxUploadScanSize, "max-upload-scan-size", 10e6, "maximum size (in bytes) of request body to scan for block-upload rules")
+	c.flags.BoolVar(&c.NormalizeText, "normalize-text", false, "normalize confusable characters, zero-width characters, and leetspeak before phrase scanning")
 	c.newActiveFlag("pac-template", "", "path to template for PAC file (%s will be replaced by proxy host:port)", c.loadPACTemplate)
 	c.newActiveFlag("password-file", "internal", "path to file of usernames and passwords", c.readPasswordFile)
 	c.flags.StringVar(&c.PIDFile, "pidfile", "", "path of file to store process ID")
+	c.flags.StringVar(&c.QuotaFile, "quota-file", "", "path to file for saving quota usage")
+	c.flags.StringVar(&c.PinningFile, "pinning-file", "", "path to file for saving the list of sites learned not to bump")
+	c.flags.IntVar(&c.PinningClients, "pinning-clients", 3, "number of different client IP addresses that must fail the handshake before a site is no longer bumped")
+	c.flags.IntVar(&c.PinningThreshold, "pinning-threshold", 0, "number of failed client handshakes (per site and client fingerprint) before a site is no longer bumped (0 to disable)")
+	c.newActiveFlag("quota-reset", "00:00", "time of day (hh:mm) when daily quotas are reset", func(s string) error {
+		var h, m int
+		if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); n != 2 || err != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+			return fmt.Errorf("invalid time of day %q", s)
+		}
+		c.QuotaReset = h*60 + m
+		return nil
+	})
 	c.newActiveFlag("query-changes", "", "path to config file for modifying URL query strings", c.loadQueryConfig)
+	c.newActiveFlag("squid-helper", "", "run as a Squid helper on standard input and output (url_rewrite or external_acl) instead of as a proxy server", c.setSquidHelper)
+	c.flags.StringVar(&c.SquidBlockURL, "squid-block-url", "", "block page URL to redirect to when running as a Squid url_rewrite helper")
 	c.flags.StringVar(&c.StarlarkLog, "starlark-log", "", "path to Starlark script log file")
+	c.flags.BoolVar(&c.ParentProxyPinAddresses, "parent-proxy-pin-addresses", false, "ask the parent proxy to connect to the server address that server-ip ACLs were checked against, instead of the hostname")
 	c.flags.StringVar(&c.StaticFilesDir, "static-files-dir", "", "path to static files for built-in web server")
+	c.flags.BoolVar(&c.StreamScan, "stream-scan", false, "phrase-scan pages longer than max-content-scan-size while sending them to the client")
+	c.flags.IntVar(&c.StreamScanWindow, "stream-scan-window", 64*1024, "number of bytes to hold back when stream-scanning a page, so that the page can be blocked before they are sent")
 	c.flags.StringVar(&c.TestURL, "test", "", "URL to test instead of running proxy server")
 	c.flags.IntVar(&c.Threshold, "threshold", 0, "minimum score for a blocked category to block a page")
 	c.flags.StringVar(&c.CertFile, "tls-cert", "", "path to certificate for serving HTTPS")
 	c.flags.StringVar(&c.KeyFile, "tls-key", "", "path to TLS certificate key")
 	c.flags.StringVar(&c.TLSLog, "tls-log", "", "path to tls log file")
+	c.newActiveFlag("parent-proxy", "", "upstream proxy (http://, https://, or socks5:// URL, or direct) to connect through, optionally followed by ACLs it applies to", c.addParentProxy)
 	c.newActiveFlag("trusted-root", "", "path to file of additional trusted root certificates (in PEM format)", c.addTrustedRoots)
 	c.newActiveFlag("verbose", "", "category of extra log messages to print", func(s string) error {
 		c.Verbose[s] = true
@@ -200,6 +306,10 @@ func loadConfiguration() (*config, error) {
 
 	c.stringListFlag("http-proxy", ":8080", "address (host:port) to listen for proxy connections on", &c.ProxyAddresses)
 	c.stringListFlag("transparent-https", "", "address to listen for intercepted HTTPS connections on", &c.TransparentAddresses)
+	c.stringListFlag("socks-proxy", "", "address to listen for SOCKS5 connections on", &c.SOCKSAddresses)
+	c.stringListFlag("icap-listen", "", "address to listen for ICAP requests on (to filter for another proxy server)", &c.ICAPAddresses)
+	c.stringListFlag("dns-proxy", "", "address to listen for DNS queries on (to remove ECH configurations from responses)", &c.DNSProxyAddresses)
+	c.flags.StringVar(&c.DNSUpstream, "dns-upstream", "", "DNS server (host:port) to forward queries from the DNS proxy to (default: the first server in /etc/resolv.conf)")
 	c.stringListFlag("category", "ads", "enable a list of built-in categories, selecting a categories folder overrides this", &c.BuiltInCategories)
 	c.stringListFlag("classifier-ignore", "", "category to omit from classifier results", &c.ClassifierIgnoredCategories)
 	c.stringListFlag("public-suffix", "", "domain to treat as a public suffix", &c.PublicSuffixes)
@@ -1,6 +1,6 @@
 // The dg-convert command takes a Dansguardian weighted phrase list on standard
-// input, and prints it in Redwood format on standard output. Any rules with
-// phrases joined by commas are dropped.
+// input, and prints it in Redwood format on standard output. Rules with
+// phrases joined by commas become combination rules.
 package main
 
 import (
@@ -32,9 +32,6 @@ func main() {
 	s := bufio.NewScanner(in)
 	for s.Scan() {
 		line := s.Text()
-		if strings.Contains(line, ">,<") {
-			continue
-		}
 
 		endPhrase := strings.Index(line, "><")
 		if endPhrase != -1 {
@@ -0,0 +1,498 @@
+package main
+
+// Download inspection: detecting the real types of downloaded files from
+// their contents (since servers often send the wrong Content-Type), and
+// listing the files inside archives, for the file-type and file-extension
+// ACLs.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// fileTypeGroups lists the more general types that each file type also
+// counts as.
+var fileTypeGroups = map[string]string{
+	"exe":   "executable",
+	"elf":   "executable",
+	"macho": "executable",
+	"zip":   "archive",
+	"gzip":  "archive",
+	"bzip2": "archive",
+	"xz":    "archive",
+	"7z":    "archive",
+	"rar":   "archive",
+	"tar":   "archive",
+	"cab":   "archive",
+	"iso":   "archive",
+	"png":   "image",
+	"jpeg":  "image",
+	"gif":   "image",
+	"webp":  "image",
+	"bmp":   "image",
+}
+
+// sniffFileType returns the type of file that data begins with, based on
+// its magic bytes, or "" if it is not recognized.
+func sniffFileType(data []byte) string {
+	prefixes := []struct {
+		magic, fileType string
+	}{
+		{"MZ", "exe"},
+		{"\x7fELF", "elf"},
+		{"\xfe\xed\xfa\xce", "macho"},
+		{"\xfe\xed\xfa\xcf", "macho"},
+		{"\xce\xfa\xed\xfe", "macho"},
+		{"\xcf\xfa\xed\xfe", "macho"},
+		{"PK\x03\x04", "zip"},
+		{"PK\x05\x06", "zip"},
+		{"PK\x07\x08", "zip"},
+		{"\x1f\x8b", "gzip"},
+		{"BZh", "bzip2"},
+		{"\xfd7zXZ\x00", "xz"},
+		{"7z\xbc\xaf\x27\x1c", "7z"},
+		{"Rar!\x1a\x07", "rar"},
+		{"MSCF", "cab"},
+		{"%PDF-", "pdf"},
+		{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "ole"},
+		{"\x89PNG\r\n\x1a\n", "png"},
+		{"\xff\xd8\xff", "jpeg"},
+		{"GIF87a", "gif"},
+		{"GIF89a", "gif"},
+		{"\x00asm", "wasm"},
+		{"#!", "script"},
+	}
+	for _, p := range prefixes {
+		if bytes.HasPrefix(data, []byte(p.magic)) {
+			return p.fileType
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("\xca\xfe\xba\xbe")) && len(data) >= 8:
+		// Java class files and universal Mach-O binaries have the same
+		// magic number; the next field is the class file version (45 or
+		// more), or the number of architectures (a small number).
+		if binary.BigEndian.Uint32(data[4:8]) < 45 {
+			return "macho"
+		}
+		return "class"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case len(data) >= 14 && string(data[:2]) == "BM" && binary.LittleEndian.Uint32(data[6:10]) == 0:
+		return "bmp"
+	case len(data) >= 262 && string(data[257:262]) == "ustar":
+		return "tar"
+	case len(data) >= 0x8006 && string(data[0x8001:0x8006]) == "CD001":
+		return "iso"
+	}
+	return ""
+}
+
+// downloadSniffSize is how much of a download is read to identify its type
+// (enough for tar and ISO images).
+const downloadSniffSize = 0x8006
+
+// downloadHeadSize is how much of a download is read at first. It is enough
+// for every signature except ISO images, but the first read may return less.
+const downloadHeadSize = 512
+
+// listsContents returns whether files of type t are archives whose contents
+// are inspected.
+func listsContents(t string) bool {
+	switch t {
+	case "zip", "tar", "gzip", "bzip2":
+		return true
+	}
+	return false
+}
+
+// inspectsDownloads returns whether a has any ACLs that require download
+// inspection.
+func (a *ACLDefinitions) inspectsDownloads() bool {
+	return len(a.FileTypes) > 0 || len(a.FileExtensions) > 0
+}
+
+// downloadACLs returns the file-type and file-extension ACLs that match
+// resp.
+func (a *ACLDefinitions) downloadACLs(resp *http.Response) map[string]bool {
+	conf := getConfig()
+	types, names := inspectDownload(resp, conf.MaxDownloadInspectSize, conf.ArchiveDepth)
+	if len(types) > 0 || len(names) > 1 {
+		logVerbose("download", "Download inspection for %v: types %q, files %q", resp.Request.URL, types, names)
+	}
+
+	acls := make(map[string]bool)
+	for _, t := range types {
+		for _, acl := range a.FileTypes[t] {
+			acls[acl] = true
+		}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		for ext, extACLs := range a.FileExtensions {
+			if strings.HasSuffix(name, "."+ext) {
+				for _, acl := range extACLs {
+					acls[acl] = true
+				}
+			}
+		}
+	}
+	return acls
+}
+
+// inspectDownload examines the body of resp, and returns the types of the
+// files it contains, and their names: the download's own filename, and the
+// names of the entries in archives (nested up to maxDepth levels). Usually
+// only the first chunk of the body is read, so that streams that send a
+// little data and then wait (like long polling) aren't held up. More is read
+// if it might be a tar file or ISO image, or if it is an archive (up to
+// maxSize bytes). The body is left ready to be read again.
+func inspectDownload(resp *http.Response, maxSize, maxDepth int) (types, names []string) {
+	if name := downloadedFilename(resp); name != "" {
+		names = append(names, name)
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		if base := path.Base(resp.Request.URL.Path); base != "/" && base != "." {
+			names = append(names, base)
+		}
+	}
+
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return types, names
+	}
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return types, names
+	}
+
+	if streamingResponse(resp) {
+		return types, names
+	}
+
+	ce := resp.Header.Get("Content-Encoding")
+	headSize := downloadHeadSize
+	if headSize > maxSize {
+		headSize = maxSize
+	}
+	buf, err := firstRead(resp.Body, headSize)
+	complete := err == io.EOF
+	limit := len(buf)
+	if err == nil {
+		want := 0
+		switch t := sniffEncoded(buf, ce); {
+		case listsContents(t) && maxDepth > 0:
+			want = maxSize
+		case t == "" && mayBeTarOrISO(resp, names):
+			want = downloadSniffSize
+		}
+		if want > maxSize {
+			want = maxSize
+		}
+		if want > len(buf) {
+			limit = want
+			more, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit-len(buf))+1))
+			buf = append(buf, more...)
+			complete = err == nil && len(buf) <= limit
+		}
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+
+	if len(buf) > limit {
+		buf = buf[:limit]
+	}
+
+	in := &downloadInspector{
+		budget:   4 * int64(maxSize),
+		maxDepth: maxDepth,
+		names:    names,
+	}
+
+	data := buf
+	if ce != "" {
+		r, err := decompressReader(ce, bytes.NewReader(buf))
+		if err != nil {
+			return types, names
+		}
+		data, complete = in.read(r)
+	}
+
+	in.inspect(data, complete, 0)
+	return in.types, in.names
+}
+
+// firstRead reads from r until it returns some data (up to size bytes) or an
+// error.
+func firstRead(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 || err != nil || size == 0 {
+			return buf[:n], err
+		}
+	}
+}
+
+// streamingResponse returns whether resp is a stream that may never end, or
+// may pause indefinitely between messages (server-sent events, live audio
+// and video, etc.), so its body shouldn't be held back for inspection.
+func streamingResponse(resp *http.Response) bool {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case ct == "text/event-stream", ct == "multipart/x-mixed-replace", ct == "application/x-ndjson", strings.HasPrefix(ct, "application/grpc"):
+		return true
+	case strings.HasPrefix(ct, "audio/"), strings.HasPrefix(ct, "video/"):
+		return resp.ContentLength < 0
+	}
+	return false
+}
+
+// mayBeTarOrISO returns whether a download that wasn't recognized from its
+// first chunk might be a tar file or ISO image (whose signatures are further
+// in), judging by its Content-Type and names.
+func mayBeTarOrISO(resp *http.Response, names []string) bool {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch ct {
+	case "", "application/octet-stream", "binary/octet-stream", "application/x-tar", "application/x-gtar", "application/x-iso9660-image", "application/x-cd-image":
+		return true
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".iso") {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffEncoded returns the file type of the beginning of a download that
+// may be compressed with Content-Encoding ce.
+func sniffEncoded(buf []byte, ce string) string {
+	if ce != "" {
+		r, err := decompressReader(ce, bytes.NewReader(buf))
+		if err != nil {
+			return ""
+		}
+		head := make([]byte, downloadSniffSize)
+		n, _ := io.ReadFull(r, head)
+		buf = head[:n]
+	}
+	return sniffFileType(buf)
+}
+
+// A downloadInspector collects the types and names of the files in a
+// download.
+type downloadInspector struct {
+	types    []string
+	names    []string
+	maxDepth int
+
+	// budget is how many more bytes may be decompressed.
+	budget int64
+}
+
+func (in *downloadInspector) addType(t string) {
+	for _, t2 := range in.types {
+		if t2 == t {
+			return
+		}
+	}
+	in.types = append(in.types, t)
+	if group, ok := fileTypeGroups[t]; ok {
+		in.addType(group)
+	}
+}
+
+// read reads from r until EOF or until the budget is used up. It returns
+// whether it read everything.
+func (in *downloadInspector) read(r io.Reader) (data []byte, complete bool) {
+	data, err := io.ReadAll(io.LimitReader(r, in.budget+1))
+	complete = err == nil && int64(len(data)) <= in.budget
+	if !complete && int64(len(data)) > in.budget {
+		data = data[:in.budget]
+	}
+	in.budget -= int64(len(data))
+	return data, complete
+}
+
+// inspect records the type of the file in data, and if it is an archive,
+// inspects its contents. depth is how many archives it is nested in.
+func (in *downloadInspector) inspect(data []byte, complete bool, depth int) {
+	t := sniffFileType(data)
+	if t == "" {
+		return
+	}
+	in.addType(t)
+	if depth >= in.maxDepth {
+		return
+	}
+
+	switch t {
+	case "zip":
+		in.inspectZip(data, complete, depth+1)
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				in.entry(hdr.Name, tr, depth+1)
+			}
+		}
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		in.entry(gr.Name, gr, depth+1)
+	case "bzip2":
+		in.entry("", bzip2.NewReader(bytes.NewReader(data)), depth+1)
+	}
+}
+
+// entry inspects one file from an archive.
+func (in *downloadInspector) entry(name string, r io.Reader, depth int) {
+	if name != "" {
+		in.names = append(in.names, name)
+	}
+
+	// Read enough to identify the file type (including tar and ISO
+	// images), and only read the rest if it's an archive.
+	head := make([]byte, downloadSniffSize)
+	n, err := io.ReadFull(r, head)
+	head = head[:n]
+	if in.budget -= int64(n); in.budget < 0 {
+		return
+	}
+	if err != nil {
+		in.inspect(head, true, depth)
+		return
+	}
+
+	if listsContents(sniffFileType(head)) && depth < in.maxDepth {
+		rest, complete := in.read(r)
+		in.inspect(append(head, rest...), complete, depth)
+		return
+	}
+	in.inspect(head, false, depth)
+}
+
+// inspectZip lists the entries in a ZIP file. If the file is incomplete
+// (because it was too big to buffer), the central directory at the end is
+// missing, so it reads the local file headers instead.
+func (in *downloadInspector) inspectZip(data []byte, complete bool, depth int) {
+	if complete {
+		if zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			for _, f := range zr.File {
+				in.zipEntryName(f.Name)
+				if f.FileInfo().IsDir() {
+					continue
+				}
+				rc, err := f.Open()
+				if err != nil {
+					continue
+				}
+				in.entry(f.Name, rc, depth)
+				rc.Close()
+				if in.budget <= 0 {
+					return
+				}
+			}
+			return
+		}
+	}
+
+	for pos := 0; pos+30 <= len(data) && in.budget > 0; {
+		if string(data[pos:pos+4]) != "PK\x03\x04" {
+			return
+		}
+		flags := binary.LittleEndian.Uint16(data[pos+6:])
+		method := binary.LittleEndian.Uint16(data[pos+8:])
+		compressedSize := int(binary.LittleEndian.Uint32(data[pos+18:]))
+		nameLen := int(binary.LittleEndian.Uint16(data[pos+26:]))
+		extraLen := int(binary.LittleEndian.Uint16(data[pos+28:]))
+
+		nameEnd := pos + 30 + nameLen
+		if nameEnd > len(data) {
+			return
+		}
+		name := string(data[pos+30 : nameEnd])
+		in.zipEntryName(name)
+
+		start := nameEnd + extraLen
+		if start > len(data) {
+			return
+		}
+		if flags&0x8 != 0 {
+			// The sizes are in a data descriptor after the data. The end of
+			// the data can still be found if it is compressed, since deflate
+			// streams mark their own end.
+			if method != zip.Deflate {
+				in.names = append(in.names, name)
+				return
+			}
+			body := bytes.NewReader(data[start:])
+			fr := flate.NewReader(body)
+			in.entry(name, fr, depth)
+			lr := &io.LimitedReader{R: fr, N: in.budget}
+			_, err := io.Copy(io.Discard, lr)
+			in.budget = lr.N
+			if err != nil || in.budget <= 0 {
+				return
+			}
+			pos = len(data) - body.Len()
+			if pos+4 <= len(data) && string(data[pos:pos+4]) == "PK\x07\x08" {
+				pos += 16
+			} else {
+				pos += 12
+			}
+			continue
+		}
+
+		end := start + compressedSize
+		if end > len(data) {
+			end = len(data)
+		}
+		body := bytes.NewReader(data[start:end])
+		if !strings.HasSuffix(name, "/") {
+			switch method {
+			case zip.Store:
+				in.entry(name, body, depth)
+			case zip.Deflate:
+				in.entry(name, flate.NewReader(body), depth)
+			default:
+				in.names = append(in.names, name)
+			}
+		}
+		pos = end
+	}
+}
+
+// zipEntryName records the special types of ZIP files that can be
+// recognized by the names of their entries.
+func (in *downloadInspector) zipEntryName(name string) {
+	switch name {
+	case "META-INF/MANIFEST.MF":
+		in.addType("jar")
+	case "AndroidManifest.xml":
+		in.addType("apk")
+	case "[Content_Types].xml":
+		in.addType("ooxml")
+	case "mimetype":
+		in.addType("odf")
+	}
+}
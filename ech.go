@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Encrypted Client Hello (ECH)
+//
+// When a client uses ECH, the SNI that Redwood sees is the "outer" public
+// name of the client-facing server (such as a CDN front), not the name of
+// the site the user is actually visiting. Sessions that use ECH get the
+// "ech" ACL, so that policies can block them or force them to be bumped.
+// (When a connection is bumped, the client sees a certificate for the outer
+// name, and it retries without ECH, revealing the real server name.)
+//
+// Clients get ECH configurations from DNS HTTPS records, so a DNS proxy is
+// also provided, which can remove the configurations from those records.
+
+// echStatus describes what Redwood knows about the server name of a session
+// that uses ECH, for the TLS log.
+func echStatus(action string) string {
+	switch action {
+	case "ssl-bump":
+		return "ech: bumped with outer name; client should retry without ECH"
+	case "block":
+		return "ech: blocked; inner name hidden"
+	default:
+		return "ech: filtered by outer name only; inner name hidden"
+	}
+}
+
+// runDNSProxy listens for DNS queries on addr (with both UDP and TCP), and
+// forwards them to the upstream DNS server, removing ECH configurations from
+// the responses where the strip-ech action applies.
+func runDNSProxy(addr string) error {
+	errChan := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: dns.HandlerFunc(handleDNSQuery),
+		}
+		go func() {
+			errChan <- server.ListenAndServe()
+		}()
+		go func() {
+			<-shutdownChan
+			server.Shutdown()
+		}()
+	}
+	return <-errChan
+}
+
+func handleDNSQuery(w dns.ResponseWriter, req *dns.Msg) {
+	conf := getConfig()
+	upstream := conf.DNSUpstream
+	if upstream == "" {
+		upstream = dnsServer
+	}
+
+	client := &dns.Client{Net: w.RemoteAddr().Network()}
+	resp, _, err := client.Exchange(req, upstream)
+	if err != nil {
+		logVerbose("dns", "Error forwarding DNS query to %s: %v", upstream, err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(resp)
+		return
+	}
+
+	for _, q := range req.Question {
+		if q.Qtype != dns.TypeHTTPS && q.Qtype != dns.TypeSVCB {
+			continue
+		}
+		if conf.shouldStripECH(w.RemoteAddr(), q.Name) {
+			resp.Answer = stripECHConfigs(resp.Answer)
+			resp.Extra = stripECHConfigs(resp.Extra)
+			logVerbose("dns", "Removed ECH configuration from %s response for %s", dns.TypeToString[q.Qtype], q.Name)
+		}
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		logVerbose("dns", "Error sending DNS response to %v: %v", w.RemoteAddr(), err)
+	}
+}
+
+// shouldStripECH returns whether the strip-ech action applies to a query
+// from client for name. The ACLs are evaluated for a virtual CONNECT request
+// to port 443 of name.
+func (conf *config) shouldStripECH(client net.Addr, name string) bool {
+	host := strings.TrimSuffix(name, ".")
+	cr := &http.Request{
+		Method:     "CONNECT",
+		Header:     make(http.Header),
+		Host:       net.JoinHostPort(host, "443"),
+		URL:        &url.URL{Host: host},
+		RemoteAddr: client.String(),
+	}
+
+	user := ""
+	if clientHost, _, err := net.SplitHostPort(client.String()); err == nil {
+		user = conf.IPToUser[clientHost]
+	}
+
+	tally := conf.URLRules.MatchingRules(cr.URL)
+	scores := conf.categoryScores(tally)
+	acls := conf.ACLs.requestACLs(cr, user)
+	ar, _ := conf.ChooseACLCategoryAction(acls, scores, conf.Threshold, "allow", "strip-ech")
+	return ar.Action == "strip-ech"
+}
+
+// stripECHConfigs removes the ech parameter from the HTTPS and SVCB records
+// in rrs. Since the modified records would no longer match their DNSSEC
+// signatures, the signatures are removed too.
+func stripECHConfigs(rrs []dns.RR) []dns.RR {
+	modified := make(map[uint16]bool)
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		case *dns.SVCB:
+			svcb = rr
+		default:
+			continue
+		}
+		kept := svcb.Value[:0]
+		for _, kv := range svcb.Value {
+			if kv.Key() != dns.SVCB_ECHCONFIG {
+				kept = append(kept, kv)
+			}
+		}
+		if len(kept) != len(svcb.Value) {
+			svcb.Value = kept
+			modified[rr.Header().Rrtype] = true
+		}
+	}
+
+	if len(modified) == 0 {
+		return rrs
+	}
+
+	result := rrs[:0]
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && modified[sig.TypeCovered] {
+			continue
+		}
+		result = append(result, rr)
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP country and autonomous system lookups, from local MaxMind DB files
+
+// loadGeoIPDatabase reads a MaxMind DB (.mmdb) file into memory.
+// (The database is not memory-mapped, so that the old copy can be safely
+// garbage-collected after the configuration is reloaded.)
+func loadGeoIPDatabase(filename string) (*maxminddb.Reader, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", filename, err)
+	}
+	return db, nil
+}
+
+func (conf *config) loadGeoIPCountryDB(filename string) error {
+	db, err := loadGeoIPDatabase(filename)
+	if err != nil {
+		return err
+	}
+	conf.GeoIPCountryDB = db
+	return nil
+}
+
+func (conf *config) loadGeoIPASNDB(filename string) error {
+	db, err := loadGeoIPDatabase(filename)
+	if err != nil {
+		return err
+	}
+	conf.GeoIPASNDB = db
+	return nil
+}
+
+// ipCountry returns the ISO country code for addr, or the empty string if
+// it is unknown.
+func (conf *config) ipCountry(addr net.IP) string {
+	if conf.GeoIPCountryDB == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := conf.GeoIPCountryDB.Lookup(addr, &record); err != nil {
+		logVerbose("geoip", "Error looking up country for %v: %v", addr, err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// ipASN returns the number of the autonomous system that addr belongs to,
+// or 0 if it is unknown.
+func (conf *config) ipASN(addr net.IP) uint {
+	if conf.GeoIPASNDB == nil {
+		return 0
+	}
+	var record struct {
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	if err := conf.GeoIPASNDB.Lookup(addr, &record); err != nil {
+		logVerbose("geoip", "Error looking up ASN for %v: %v", addr, err)
+		return 0
+	}
+	return record.ASN
+}
+
+// parseASN parses an autonomous system number, with or without an "AS"
+// prefix.
+func parseASN(s string) (uint, error) {
+	var n uint
+	digits := strings.TrimPrefix(strings.ToUpper(s), "AS")
+	if _, err := fmt.Sscanf(digits, "%d", &n); err != nil || fmt.Sprint(n) != digits {
+		return 0, fmt.Errorf("invalid autonomous system number: %q", s)
+	}
+	return n, nil
+}
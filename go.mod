@@ -11,6 +11,7 @@ require (
 	github.com/kylelemons/go-gypsy v1.0.0
 	github.com/miekg/dns v1.1.48
 	github.com/open-ch/ja3 v1.0.1
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/qri-io/starlib v0.5.0
 	github.com/remogatto/ftpget v0.0.0-20120222025949-5c3c8286a3b0
 	go.starlark.net v0.0.0-20220328144851-d1966c6b9fcd
@@ -0,0 +1,202 @@
+package main
+
+// SHA-256 hashes of response bodies, for blocking (or allowing) known files
+// by their exact contents.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// fileHashPrefix is the prefix for SHA-256 hash rules in category lists.
+const fileHashPrefix = "sha256:"
+
+// A hashingBody calculates the SHA-256 hash of a response body while it is
+// being copied to the client. The last chunk of the body is held back until
+// the hash has been checked, so that if it matches a blocked file, the client
+// gets only an incomplete copy.
+type hashingBody struct {
+	io.ReadCloser
+
+	response *Response
+	hash     hash.Hash
+
+	// remaining is how many more bytes may be hashed before giving up.
+	remaining int64
+
+	// sum is the hexadecimal hash, once the whole body has been read.
+	sum string
+
+	// checked is whether the hash has already been looked up (by
+	// hashBeforeFiltering).
+	checked bool
+}
+
+// canHash returns whether response's body should be hashed.
+func canHash(response *Response) bool {
+	maxSize := int64(getConfig().MaxHashSize)
+	resp := response.Response
+	switch {
+	case maxSize <= 0,
+		resp.StatusCode != http.StatusOK,
+		response.Request.Request.Method == "HEAD",
+		resp.Body == nil || resp.Body == http.NoBody,
+		resp.ContentLength > maxSize,
+		// Modified and compressed responses don't have the same contents
+		// as the original file.
+		response.Modified,
+		resp.Header.Get("Content-Encoding") != "":
+		return false
+	}
+	switch resp.Body.(type) {
+	case *streamScanner, *hashingBody:
+		return false
+	}
+	return true
+}
+
+// startHashing sets up response's body to be hashed as it is copied to the
+// client, if it should be.
+func startHashing(response *Response) {
+	if !canHash(response) {
+		return
+	}
+	resp := response.Response
+	resp.Body = &hashingBody{
+		ReadCloser: resp.Body,
+		response:   response,
+		hash:       sha256.New(),
+		remaining:  int64(getConfig().MaxHashSize),
+	}
+}
+
+// hashBeforeFiltering calculates the hash of response's body before its
+// action is chosen, if there are hash rules in categories whose action is
+// allow, so that an allowed file can override a block. It only does this for
+// responses that are small enough to buffer (up to max-hash-size).
+func hashBeforeFiltering(response *Response) {
+	conf := getConfig()
+	if len(conf.AllowedHashes) == 0 || !canHash(response) {
+		return
+	}
+	content, err := response.Content(conf.MaxHashSize)
+	if err != nil || content == nil {
+		return
+	}
+	h := sha256.Sum256(content)
+	sum := hex.EncodeToString(h[:])
+	if conf.FileHashes[sum] {
+		response.Tally[rule{t: fileHash, content: sum}]++
+		response.Scores.data = conf.categoryScores(response.Tally)
+	}
+
+	resp := response.Response
+	resp.Body = &hashingBody{
+		ReadCloser: resp.Body,
+		response:   response,
+		sum:        sum,
+		checked:    true,
+	}
+}
+
+// responseHash returns the SHA-256 hash of resp's body, if it was calculated.
+func responseHash(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	if hb, ok := resp.Body.(*hashingBody); ok {
+		return hb.sum
+	}
+	return ""
+}
+
+func (hb *hashingBody) Read(p []byte) (int, error) {
+	n, err := hb.ReadCloser.Read(p)
+	if hb.hash != nil {
+		if hb.remaining -= int64(n); hb.remaining < 0 {
+			// The body is too long to hash.
+			hb.hash = nil
+		} else {
+			hb.hash.Write(p[:n])
+		}
+	}
+	if err == io.EOF && hb.hash != nil {
+		hb.sum = hex.EncodeToString(hb.hash.Sum(nil))
+	}
+	return n, err
+}
+
+// checkHash looks up the body's hash in the hash rules, and returns the
+// action that should be taken if it matches.
+func (hb *hashingBody) checkHash() ACLActionRule {
+	if hb.checked || hb.sum == "" || !getConfig().FileHashes[hb.sum] {
+		return ACLActionRule{}
+	}
+	hb.response.Tally[rule{t: fileHash, content: hb.sum}]++
+	return hb.response.blockAction()
+}
+
+// copyTo copies the body to w, holding back the last chunk until the hash has
+// been checked. If the response is blocked before anything has been sent, it
+// returns the block rule without writing to w, so that a block page can be
+// shown. If it is blocked after that, it returns the block rule without
+// sending the last chunk, so that the response can be aborted.
+func (hb *hashingBody) copyTo(w http.ResponseWriter) (n int64, blocked ACLActionRule, err error) {
+	resp := hb.response.Response
+	var pending []byte
+	headerSent := false
+	buf := make([]byte, 32*1024)
+	spare := make([]byte, 32*1024)
+
+	send := func(data []byte) error {
+		if !headerSent {
+			if resp.ContentLength > 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+			}
+			copyResponseHeader(w, resp)
+			headerSent = true
+		}
+		written, err := w.Write(data)
+		n += int64(written)
+		return err
+	}
+
+	for {
+		nr, rerr := hb.Read(buf)
+		if nr > 0 {
+			if pending != nil {
+				if err := send(pending); err != nil {
+					return n, ACLActionRule{}, err
+				}
+			}
+			pending = buf[:nr]
+			buf, spare = spare, buf
+		}
+
+		// Servers that use broken chunked Transfer-Encoding can give us
+		// unexpected EOFs, even if we got all the content.
+		if rerr == io.ErrUnexpectedEOF && resp.ContentLength == -1 && hb.hash != nil {
+			hb.sum = hex.EncodeToString(hb.hash.Sum(nil))
+			rerr = io.EOF
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return n, ACLActionRule{}, rerr
+		}
+	}
+
+	if ar := hb.checkHash(); ar.Action != "" {
+		log.Printf("Blocked %v by its SHA-256 hash (%s): %s %s", hb.response.Request.Request.URL, hb.sum, ar.Action, ar.Conditions())
+		return n, ar, nil
+	}
+
+	err = send(pending)
+	return n, ACLActionRule{}, err
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ICAP client (RFC 3507), for sending requests and responses to external
+// content adaptation servers, such as DLP appliances and virus scanners.
+
+// icapTimeout is how long to wait for an ICAP server to respond (not
+// counting the time to transfer the modified message body).
+const icapTimeout = time.Minute
+
+// An icapService is an ICAP server that requests or responses are sent to.
+type icapService struct {
+	// Method is REQMOD or RESPMOD.
+	Method string
+
+	URL *url.URL
+
+	// Bypass is whether messages should be passed through unchanged if the
+	// server can't be reached.
+	Bypass bool
+
+	lock          sync.Mutex
+	preview       int // -1 if the server doesn't want previews
+	optionsExpire time.Time
+}
+
+// addICAPService parses the value of an icap-service option: reqmod or
+// respmod, the service's icap:// URL, and optionally "bypass".
+func (conf *config) addICAPService(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return errors.New("icap-service needs a method (reqmod or respmod) and a URL")
+	}
+
+	service := &icapService{
+		Method:  strings.ToUpper(fields[0]),
+		preview: -1,
+	}
+	if service.Method != "REQMOD" && service.Method != "RESPMOD" {
+		return fmt.Errorf("invalid ICAP method %q (expected reqmod or respmod)", fields[0])
+	}
+
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid ICAP service URL %q: %v", fields[1], err)
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return fmt.Errorf("invalid ICAP service URL %q (expected icap://host:port/service)", fields[1])
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	service.URL = u
+
+	for _, opt := range fields[2:] {
+		switch opt {
+		case "bypass":
+			service.Bypass = true
+		default:
+			return fmt.Errorf("unknown ICAP service option %q", opt)
+		}
+	}
+
+	conf.ICAPServices = append(conf.ICAPServices, service)
+	return nil
+}
+
+// icapReqmod sends the request to the REQMOD services, if the icap-reqmod
+// action applies to it. The request is updated with any changes the servers
+// make, and modified is true. If a server returns a response instead (to
+// block the request), it is returned, and the request should not be
+// forwarded.
+func icapReqmod(request *Request) (resp *http.Response, rule ACLActionRule, modified bool, err error) {
+	conf := getConfig()
+	rule, _ = conf.ChooseACLCategoryAction(request.ACLs.data, request.Scores.data, conf.Threshold, "icap-reqmod")
+	if rule.Action != "icap-reqmod" {
+		return nil, rule, false, nil
+	}
+
+	r := request.Request
+	for _, s := range conf.ICAPServices {
+		if s.Method != "REQMOD" {
+			continue
+		}
+
+		result, err := s.exchange(r.Context(), request.ClientIP, request.User, r, nil)
+		if err != nil {
+			return nil, rule, modified, err
+		}
+		switch {
+		case result == nil:
+			// The server said not to modify the request.
+		case result.Response != nil:
+			logVerbose("icap", "%s returned a response (%s) for %v", s.URL, result.Response.Status, r.URL)
+			return result.Response, rule, modified, nil
+		case result.Request != nil:
+			logVerbose("icap", "%s modified the request for %v", s.URL, r.URL)
+			mr := result.Request
+			r.Method = mr.Method
+			r.URL = mr.URL
+			r.Host = mr.Host
+			r.Header = mr.Header
+			r.Body = mr.Body
+			r.ContentLength = mr.ContentLength
+			if r.URL.Host == "" {
+				r.URL.Host = r.Host
+			}
+			if r.URL.Scheme == "" {
+				r.URL.Scheme = "http"
+			}
+			modified = true
+		}
+	}
+	return nil, rule, modified, nil
+}
+
+// icapRespmod sends the response to the RESPMOD services, if the
+// icap-respmod action applies to it. If a server modifies the response,
+// response.Response is replaced, and modified is true.
+func icapRespmod(response *Response) (rule ACLActionRule, modified bool, err error) {
+	conf := getConfig()
+	rule, _ = conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, "icap-respmod")
+	if rule.Action != "icap-respmod" {
+		return rule, false, nil
+	}
+
+	r := response.Request.Request
+	for _, s := range conf.ICAPServices {
+		if s.Method != "RESPMOD" {
+			continue
+		}
+
+		result, err := s.exchange(r.Context(), response.Request.ClientIP, response.Request.User, r, response.Response)
+		if err != nil {
+			return rule, modified, err
+		}
+		if result == nil || result.Response == nil {
+			continue
+		}
+		logVerbose("icap", "%s modified the response (%s) for %v", s.URL, result.Response.Status, r.URL)
+		result.Response.Request = r
+		response.Response = result.Response
+		response.Modified = true
+		modified = true
+	}
+	return rule, modified, nil
+}
+
+// serveICAPResponse sends a response that an ICAP server returned to the
+// client, and returns the number of bytes of the body that were sent.
+func serveICAPResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) int64 {
+	copyResponseHeader(w, resp)
+	n, err := io.Copy(w, resp.Body)
+	if err != nil && err != context.Canceled {
+		log.Printf("error while copying ICAP response (URL: %s): %s", r.URL, err)
+	}
+	return n
+}
+
+// An icapResult is the HTTP message that an ICAP server returned. It is
+// nil if the server returned 204 No Content (meaning the original message
+// should be used unchanged).
+type icapResult struct {
+	Request  *http.Request
+	Response *http.Response
+}
+
+// exchange sends a message to s, and returns the modified message. For
+// REQMOD, resp should be nil. The body of the original message is replaced
+// with an equivalent one, so that it can still be used if the server
+// doesn't modify the message.
+func (s *icapService) exchange(ctx context.Context, clientIP, user string, req *http.Request, resp *http.Response) (*icapResult, error) {
+	preview := s.getPreview(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, icapTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", s.URL.Host)
+	if err != nil {
+		if s.Bypass {
+			log.Printf("Error connecting to ICAP service %s (bypassing): %v", s.URL, err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error connecting to ICAP service %s: %v", s.URL, err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	success := false
+	defer func() {
+		if !success {
+			conn.Close()
+		}
+	}()
+
+	// Figure out which body we are sending.
+	var bodyPtr *io.ReadCloser
+	switch {
+	case resp != nil:
+		if resp.Body != nil && resp.Body != http.NoBody && req.Method != "HEAD" {
+			bodyPtr = &resp.Body
+		}
+	case req.Body != nil && req.Body != http.NoBody:
+		bodyPtr = &req.Body
+	}
+
+	// Read as much of the body as we can keep in memory. If all of it
+	// fits, we can accept a 204 response even after sending the whole body.
+	var head []byte
+	var rest io.Reader
+	complete := true
+	if bodyPtr != nil {
+		limit := getConfig().MaxContentScanSize
+		if preview > limit {
+			limit = preview
+		}
+		lr := &io.LimitedReader{R: *bodyPtr, N: int64(limit) + 1}
+		head, err = io.ReadAll(lr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading body to send to ICAP service: %v", err)
+		}
+		if lr.N == 0 {
+			complete = false
+			rest = *bodyPtr
+			*bodyPtr = readCloser{io.MultiReader(bytes.NewReader(head), rest), *bodyPtr}
+		} else {
+			Lce((*bodyPtr).Close())
+			*bodyPtr = io.NopCloser(bytes.NewReader(head))
+		}
+	}
+
+	// Encapsulated HTTP headers
+	var encapsulated []string
+	var hdrs bytes.Buffer
+	encapsulated = append(encapsulated, fmt.Sprintf("req-hdr=%d", hdrs.Len()))
+	writeICAPRequestHeader(&hdrs, req)
+	bodyName := "req-body"
+	if resp != nil {
+		encapsulated = append(encapsulated, fmt.Sprintf("res-hdr=%d", hdrs.Len()))
+		writeICAPResponseHeader(&hdrs, resp)
+		bodyName = "res-body"
+	}
+	if bodyPtr == nil {
+		bodyName = "null-body"
+	}
+	encapsulated = append(encapsulated, fmt.Sprintf("%s=%d", bodyName, hdrs.Len()))
+
+	bw := bufio.NewWriter(conn)
+	fmt.Fprintf(bw, "%s %s ICAP/1.0\r\n", s.Method, s.URL)
+	fmt.Fprintf(bw, "Host: %s\r\n", s.URL.Host)
+	fmt.Fprintf(bw, "Encapsulated: %s\r\n", strings.Join(encapsulated, ", "))
+	if complete {
+		fmt.Fprint(bw, "Allow: 204\r\n")
+	}
+	if clientIP != "" {
+		fmt.Fprintf(bw, "X-Client-IP: %s\r\n", clientIP)
+	}
+	if user != "" {
+		fmt.Fprintf(bw, "X-Client-Username: %s\r\n", stripControlChars(user))
+	}
+	previewing := bodyPtr != nil && preview >= 0
+	if previewing {
+		if preview > len(head) {
+			preview = len(head)
+		}
+		fmt.Fprintf(bw, "Preview: %d\r\n", preview)
+	}
+	bw.WriteString("\r\n")
+	hdrs.WriteTo(bw)
+
+	br := bufio.NewReader(conn)
+	tr := textproto.NewReader(br)
+
+	var status int
+	var header textproto.MIMEHeader
+	if previewing {
+		writeICAPChunk(bw, head[:preview])
+		if preview == len(head) && complete {
+			bw.WriteString("0; ieof\r\n\r\n")
+		} else {
+			bw.WriteString("0\r\n\r\n")
+		}
+		if err := bw.Flush(); err != nil {
+			return nil, fmt.Errorf("error sending preview to ICAP service %s: %v", s.URL, err)
+		}
+		status, header, err = readICAPResponseHeader(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response from ICAP service %s: %v", s.URL, err)
+		}
+		if status == 100 {
+			// Send the rest of the body.
+			remaining := io.Reader(bytes.NewReader(head[preview:]))
+			if !complete {
+				remaining = io.MultiReader(remaining, rest)
+			}
+			go sendICAPBody(bw, conn, remaining, s.URL)
+			status, header, err = readICAPResponseHeader(tr)
+			if err != nil {
+				return nil, fmt.Errorf("error reading response from ICAP service %s: %v", s.URL, err)
+			}
+			if status == 204 && !complete {
+				return nil, fmt.Errorf("ICAP service %s returned 204 No Content after the body was sent", s.URL)
+			}
+		}
+	} else {
+		if bodyPtr != nil {
+			body := io.Reader(bytes.NewReader(head))
+			if !complete {
+				body = io.MultiReader(body, rest)
+			}
+			go sendICAPBody(bw, conn, body, s.URL)
+		} else if err := bw.Flush(); err != nil {
+			return nil, fmt.Errorf("error sending request to ICAP service %s: %v", s.URL, err)
+		}
+		status, header, err = readICAPResponseHeader(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response from ICAP service %s: %v", s.URL, err)
+		}
+		if status == 204 && !complete {
+			return nil, fmt.Errorf("ICAP service %s returned 204 No Content after the body was sent", s.URL)
+		}
+	}
+
+	switch status {
+	case 204:
+		return nil, nil
+	case 200:
+	default:
+		return nil, fmt.Errorf("ICAP service %s returned status %d", s.URL, status)
+	}
+
+	// Parse the encapsulated message.
+	result := new(icapResult)
+	hasBody := false
+	for _, part := range strings.Split(header.Get("Encapsulated"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "req-hdr":
+			result.Request, err = http.ReadRequest(br)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing request from ICAP service %s: %v", s.URL, err)
+			}
+		case "res-hdr":
+			result.Response, err = http.ReadResponse(br, req)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing response from ICAP service %s: %v", s.URL, err)
+			}
+		case "req-body", "res-body":
+			hasBody = true
+		}
+	}
+	if resp != nil && result.Response == nil {
+		return nil, fmt.Errorf("ICAP service %s returned a RESPMOD result without a response", s.URL)
+	}
+
+	conn.SetDeadline(time.Time{})
+	var body io.ReadCloser = http.NoBody
+	if hasBody {
+		body = readCloser{httputil.NewChunkedReader(br), conn}
+		success = true
+	}
+
+	// The body is re-encoded as chunks, so the Content-Length may no longer
+	// be correct.
+	if result.Response != nil {
+		result.Response.Body = body
+		result.Response.ContentLength = -1
+		result.Response.Header.Del("Content-Length")
+		result.Response.TransferEncoding = nil
+		if !hasBody {
+			result.Response.ContentLength = 0
+		}
+	} else if result.Request != nil {
+		result.Request.Body = body
+		result.Request.ContentLength = -1
+		result.Request.Header.Del("Content-Length")
+		result.Request.TransferEncoding = nil
+		if !hasBody {
+			result.Request.ContentLength = 0
+		}
+	}
+	return result, nil
+}
+
+// getPreview returns the preview size that s asks for in its OPTIONS
+// response, or -1 if it doesn't want previews. The OPTIONS response is
+// cached for the time it specifies (or an hour).
+func (s *icapService) getPreview(ctx context.Context) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if time.Now().Before(s.optionsExpire) {
+		return s.preview
+	}
+
+	// If the OPTIONS request fails, try again in a minute.
+	s.optionsExpire = time.Now().Add(time.Minute)
+
+	ctx, cancel := context.WithTimeout(ctx, icapTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", s.URL.Host)
+	if err != nil {
+		logVerbose("icap", "Error connecting to %s for OPTIONS: %v", s.URL, err)
+		return s.preview
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	_, err = fmt.Fprintf(conn, "OPTIONS %s ICAP/1.0\r\nHost: %s\r\nEncapsulated: null-body=0\r\n\r\n", s.URL, s.URL.Host)
+	if err != nil {
+		logVerbose("icap", "Error sending OPTIONS request to %s: %v", s.URL, err)
+		return s.preview
+	}
+	status, header, err := readICAPResponseHeader(textproto.NewReader(bufio.NewReader(conn)))
+	if err != nil || status != 200 {
+		logVerbose("icap", "Error getting OPTIONS from %s: status %d, %v", s.URL, status, err)
+		return s.preview
+	}
+
+	s.preview = -1
+	if p, err := strconv.Atoi(header.Get("Preview")); err == nil && p >= 0 {
+		s.preview = p
+	}
+	ttl := time.Hour
+	if t, err := strconv.Atoi(header.Get("Options-TTL")); err == nil && t > 0 {
+		ttl = time.Duration(t) * time.Second
+	}
+	s.optionsExpire = time.Now().Add(ttl)
+	return s.preview
+}
+
+// stripControlChars removes control characters (including CR and LF) from
+// s, so that it can be used as a header value.
+func stripControlChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// readICAPResponseHeader reads the status line and headers of an ICAP
+// response.
+func readICAPResponseHeader(tr *textproto.Reader) (status int, header textproto.MIMEHeader, err error) {
+	line, err := tr.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return 0, nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	code, _, _ := strings.Cut(rest, " ")
+	status, err = strconv.Atoi(code)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	header, err = tr.ReadMIMEHeader()
+	return status, header, err
+}
+
+// writeICAPRequestHeader writes the request line and headers of req, for
+// encapsulation in an ICAP message.
+func writeICAPRequestHeader(w io.Writer, req *http.Request) {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL)
+	fmt.Fprintf(w, "Host: %s\r\n", req.Host)
+	req.Header.Write(w)
+	io.WriteString(w, "\r\n")
+}
+
+// writeICAPResponseHeader writes the status line and headers of resp, for
+// encapsulation in an ICAP message.
+func writeICAPResponseHeader(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.WriteSubset(w, map[string]bool{cacheStatusHeader: true})
+	io.WriteString(w, "\r\n")
+}
+
+func writeICAPChunk(w *bufio.Writer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%x\r\n", len(data))
+	w.Write(data)
+	w.WriteString("\r\n")
+}
+
+// sendICAPBody sends body to an ICAP server, in chunked encoding.
+// If the body can't be read, the connection is closed, since there is no way
+// to tell the server that the message is incomplete.
+func sendICAPBody(bw *bufio.Writer, conn net.Conn, body io.Reader, service *url.URL) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		writeICAPChunk(bw, buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading body to send to ICAP service %s: %v", service, err)
+			conn.Close()
+			return
+		}
+	}
+	bw.WriteString("0\r\n\r\n")
+	if err := bw.Flush(); err != nil {
+		logVerbose("icap", "Error sending body to ICAP service %s: %v", service, err)
+	}
+}
+
+// A readCloser combines a Reader with a separate Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fakeICAPServer is a minimal ICAP server for testing the client, in the
+// style of httptest.Server.
+type fakeICAPServer struct {
+	listener net.Listener
+
+	// Preview is the preview size advertised in the OPTIONS response, or -1
+	// for none.
+	Preview int
+
+	// Handle is called for each REQMOD or RESPMOD request, with the
+	// encapsulated headers and the complete body, and writes the response.
+	// It is called after the preview (if any) has been answered.
+	Handle func(req *fakeICAPRequest, w io.Writer)
+
+	// Continue is whether to answer a preview with 100 Continue; if it is
+	// false, Handle is called with just the preview.
+	Continue bool
+
+	mu       sync.Mutex
+	options  int
+	requests []*fakeICAPRequest
+}
+
+// A fakeICAPRequest is a request that was received by a fakeICAPServer.
+type fakeICAPRequest struct {
+	Method    string
+	Header    textproto.MIMEHeader
+	HTTPHead  string // the encapsulated HTTP headers
+	Body      []byte
+	Previewed []byte // the part of the body that was sent as a preview
+	IEOF      bool   // whether the preview ended with "ieof"
+}
+
+func newFakeICAPServer(t *testing.T) *fakeICAPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeICAPServer{listener: l, Preview: -1}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+// service returns an icapService that connects to s.
+func (s *fakeICAPServer) service(method string) *icapService {
+	return &icapService{
+		Method:  method,
+		URL:     &url.URL{Scheme: "icap", Host: s.listener.Addr().String(), Path: "/" + strings.ToLower(method)},
+		preview: -1,
+	}
+}
+
+func (s *fakeICAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tr := textproto.NewReader(br)
+
+	line, err := tr.ReadLine()
+	if err != nil {
+		return
+	}
+	method, _, _ := strings.Cut(line, " ")
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	if method == "OPTIONS" {
+		s.mu.Lock()
+		s.options++
+		s.mu.Unlock()
+		fmt.Fprint(conn, "ICAP/1.0 200 OK\r\nMethods: REQMOD, RESPMOD\r\nOptions-TTL: 60\r\n")
+		if s.Preview >= 0 {
+			fmt.Fprintf(conn, "Preview: %d\r\n", s.Preview)
+		}
+		fmt.Fprint(conn, "Encapsulated: null-body=0\r\n\r\n")
+		return
+	}
+
+	req := &fakeICAPRequest{Method: method, Header: header}
+
+	// Read the encapsulated headers, which end where the body starts.
+	bodyStart, hasBody := 0, false
+	for _, part := range strings.Split(header.Get("Encapsulated"), ",") {
+		name, offset, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.HasSuffix(name, "-body") {
+			bodyStart, _ = strconv.Atoi(offset)
+			hasBody = name != "null-body"
+		}
+	}
+	head := make([]byte, bodyStart)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return
+	}
+	req.HTTPHead = string(head)
+
+	if hasBody {
+		body, ieof, err := readFakeICAPChunks(tr)
+		if err != nil {
+			return
+		}
+		if header.Get("Preview") != "" {
+			req.Previewed = body
+			req.IEOF = ieof
+			if s.Continue && !ieof {
+				fmt.Fprint(conn, "ICAP/1.0 100 Continue\r\n\r\n")
+				rest, _, err := readFakeICAPChunks(tr)
+				if err != nil {
+					return
+				}
+				body = append(body, rest...)
+			}
+		}
+		req.Body = body
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	s.Handle(req, conn)
+}
+
+// request returns the first REQMOD or RESPMOD request that s received.
+func (s *fakeICAPServer) request() *fakeICAPRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[0]
+}
+
+// readFakeICAPChunks reads a chunked body, and reports whether the last
+// chunk had the ieof extension.
+func readFakeICAPChunks(tr *textproto.Reader) (body []byte, ieof bool, err error) {
+	for {
+		line, err := tr.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		sizeStr, ext, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		if size == 0 {
+			_, err := tr.ReadLine()
+			return body, strings.TrimSpace(ext) == "ieof", err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(tr.R, chunk); err != nil {
+			return nil, false, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// writeFakeICAPResponse writes a 200 response encapsulating an HTTP message
+// header and body.
+func writeFakeICAPResponse(w io.Writer, headName, httpHead, body string) {
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nEncapsulated: %s=0, ", headName)
+	bodyName := "res-body"
+	if headName == "req-hdr" {
+		bodyName = "req-body"
+	}
+	fmt.Fprintf(w, "%s=%d\r\n\r\n%s", bodyName, len(httpHead), httpHead)
+	fmt.Fprintf(w, "%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+}
+
+func setICAPTestConfig() {
+	configuration = &config{MaxContentScanSize: 1e6}
+}
+
+func TestICAPOptions(t *testing.T) {
+	setICAPTestConfig()
+	srv := newFakeICAPServer(t)
+	srv.Preview = 10
+	s := srv.service("RESPMOD")
+
+	if p := s.getPreview(context.Background()); p != 10 {
+		t.Fatalf("getPreview = %d, want 10", p)
+	}
+	if p := s.getPreview(context.Background()); p != 10 {
+		t.Fatalf("second getPreview = %d, want 10", p)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.options != 1 {
+		t.Errorf("server got %d OPTIONS requests, want 1 (the result should be cached)", srv.options)
+	}
+}
+
+func TestICAPPreviewContinue(t *testing.T) {
+	setICAPTestConfig()
+	srv := newFakeICAPServer(t)
+	srv.Preview = 4
+	srv.Continue = true
+	srv.Handle = func(req *fakeICAPRequest, w io.Writer) {
+		writeFakeICAPResponse(w, "res-hdr", "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n", strings.ToUpper(string(req.Body)))
+	}
+	s := srv.service("RESPMOD")
+
+	req, _ := http.NewRequest("GET", "http://example.com/file.txt", nil)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("hello, world")),
+		Request:    req,
+	}
+	result, err := s.exchange(context.Background(), "10.0.0.1", "", req, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Response == nil {
+		t.Fatal("expected a modified response")
+	}
+	body, err := io.ReadAll(result.Response.Body)
+	result.Response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO, WORLD" {
+		t.Errorf("modified body = %q, want %q", body, "HELLO, WORLD")
+	}
+
+	got := srv.request()
+	if string(got.Previewed) != "hell" || got.IEOF {
+		t.Errorf("preview = %q (ieof %v), want %q without ieof", got.Previewed, got.IEOF, "hell")
+	}
+	if string(got.Body) != "hello, world" {
+		t.Errorf("server received body %q, want the whole body", got.Body)
+	}
+	if got.Header.Get("X-Client-IP") != "10.0.0.1" {
+		t.Errorf("X-Client-IP = %q", got.Header.Get("X-Client-IP"))
+	}
+}
+
+func TestICAPNoContent(t *testing.T) {
+	setICAPTestConfig()
+	srv := newFakeICAPServer(t)
+	srv.Preview = 1024
+	srv.Handle = func(req *fakeICAPRequest, w io.Writer) {
+		fmt.Fprint(w, "ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n")
+	}
+	s := srv.service("REQMOD")
+
+	req, _ := http.NewRequest("POST", "http://example.com/upload", strings.NewReader("some data"))
+	result, err := s.exchange(context.Background(), "", "", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil {
+		t.Fatalf("expected no modification, got %+v", result)
+	}
+
+	got := srv.request()
+	if !got.IEOF || string(got.Previewed) != "some data" {
+		t.Errorf("preview = %q (ieof %v), want the whole body with ieof", got.Previewed, got.IEOF)
+	}
+	if got.Header.Get("Allow") != "204" {
+		t.Errorf("Allow = %q, want 204", got.Header.Get("Allow"))
+	}
+
+	// The original body should still be available to forward.
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "some data" {
+		t.Errorf("request body after 204 = %q, want %q", body, "some data")
+	}
+}
+
+func TestICAPModifiedRequest(t *testing.T) {
+	setICAPTestConfig()
+	srv := newFakeICAPServer(t)
+	srv.Handle = func(req *fakeICAPRequest, w io.Writer) {
+		writeFakeICAPResponse(w, "req-hdr", "POST /cleaned HTTP/1.1\r\nHost: example.com\r\nX-Scanned: yes\r\n\r\n", "redacted")
+	}
+	s := srv.service("REQMOD")
+
+	req, _ := http.NewRequest("POST", "http://example.com/upload", strings.NewReader("secret"))
+	req.Header.Set("Content-Type", "text/plain")
+	result, err := s.exchange(context.Background(), "", "alice", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || result.Request == nil {
+		t.Fatal("expected a modified request")
+	}
+	mr := result.Request
+	if mr.URL.Path != "/cleaned" || mr.Header.Get("X-Scanned") != "yes" {
+		t.Errorf("modified request = %s %v %v", mr.Method, mr.URL, mr.Header)
+	}
+	body, _ := io.ReadAll(mr.Body)
+	mr.Body.Close()
+	if string(body) != "redacted" {
+		t.Errorf("modified body = %q, want %q", body, "redacted")
+	}
+	if mr.ContentLength != -1 {
+		t.Errorf("ContentLength = %d, want -1", mr.ContentLength)
+	}
+
+	got := srv.request()
+	if !bytes.Equal(got.Body, []byte("secret")) {
+		t.Errorf("server received body %q", got.Body)
+	}
+	if !strings.HasPrefix(got.HTTPHead, "POST http://example.com/upload HTTP/1.1\r\n") {
+		t.Errorf("encapsulated header = %q", got.HTTPHead)
+	}
+	if got.Header.Get("X-Client-Username") != "alice" {
+		t.Errorf("X-Client-Username = %q", got.Header.Get("X-Client-Username"))
+	}
+}
+
+// setICAPFilterConfig sets up a configuration with the ACL rules in acls,
+// and a REQMOD service at srv.
+func setICAPFilterConfig(t *testing.T, acls string, srv *fakeICAPServer) {
+	filename := filepath.Join(t.TempDir(), "acls.conf")
+	if err := os.WriteFile(filename, []byte(acls), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config{
+		MaxContentScanSize: 1e6,
+		URLRules:           newURLMatcher(),
+		ICAPServices:       []*icapService{srv.service("REQMOD")},
+	}
+	if err := conf.ACLs.load(filename); err != nil {
+		t.Fatal(err)
+	}
+	configuration = conf
+}
+
+// rewriteRequestTo returns a fakeICAPServer handler that changes the
+// request's URL to u.
+func rewriteRequestTo(u string) func(req *fakeICAPRequest, w io.Writer) {
+	return func(req *fakeICAPRequest, w io.Writer) {
+		parsed, _ := url.Parse(u)
+		writeFakeICAPResponse(w, "req-hdr", fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", u, parsed.Host), "")
+	}
+}
+
+func TestICAPModifiedRequestRefiltered(t *testing.T) {
+	srv := newFakeICAPServer(t)
+	srv.Handle = rewriteRequestTo("http://blocked.example.com/")
+	setICAPFilterConfig(t, "acl rewritten url blocked.example.com\nblock rewritten\nicap-reqmod\n", srv)
+
+	req, _ := http.NewRequest("GET", "http://allowed.example.com/", nil)
+	request := &Request{Request: req}
+	filterRequest(request, false)
+	if request.Action.Action != "allow" {
+		t.Fatalf("original request's action = %q, want allow", request.Action.Action)
+	}
+
+	_, _, modified, err := icapReqmod(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modified {
+		t.Fatal("request was not modified")
+	}
+	refilterRequest(request)
+	if request.Action.Action != "block" {
+		t.Errorf("rewritten request's action = %q, want block", request.Action.Action)
+	}
+}
+
+func TestICAPModifiedRequestServerIP(t *testing.T) {
+	srv := newFakeICAPServer(t)
+	srv.Handle = rewriteRequestTo("http://192.0.2.2/")
+	setICAPFilterConfig(t, "acl new-server server-ip 192.0.2.2\nblock new-server\nicap-reqmod\n", srv)
+
+	req, _ := http.NewRequest("GET", "http://192.0.2.1/", nil)
+	request := &Request{Request: req}
+	filterRequest(request, false)
+	if request.Action.Action != "allow" {
+		t.Fatalf("original request's action = %q, want allow", request.Action.Action)
+	}
+
+	if _, _, _, err := icapReqmod(request); err != nil {
+		t.Fatal(err)
+	}
+	refilterRequest(request)
+	if request.Action.Action != "block" {
+		t.Errorf("rewritten request's action = %q, want block (server-ip checked against the old host?)", request.Action.Action)
+	}
+	if rs := resolvedServerFromContext(request.Request.Context()); rs == nil || rs.Host != "192.0.2.2" {
+		t.Errorf("resolved server = %+v, want 192.0.2.2", rs)
+	}
+}
+
+func TestICAPUsernameHeaderInjection(t *testing.T) {
+	setICAPTestConfig()
+	srv := newFakeICAPServer(t)
+	srv.Handle = func(req *fakeICAPRequest, w io.Writer) {
+		fmt.Fprint(w, "ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n")
+	}
+	s := srv.service("REQMOD")
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := s.exchange(context.Background(), "", "mallory\r\nX-Injected: yes", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := srv.request()
+	if got.Header.Get("X-Injected") != "" {
+		t.Error("username injected an ICAP header")
+	}
+	if u := got.Header.Get("X-Client-Username"); u != "malloryX-Injected: yes" {
+		t.Errorf("X-Client-Username = %q", u)
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ICAP server (RFC 3507), so that another proxy (such as Squid) can use
+// Redwood's filtering. REQMOD requests are filtered like the requests that
+// come to the HTTP proxy, and RESPMOD requests like its responses.
+
+// icapIdleTimeout is how long to keep an idle ICAP connection open.
+const icapIdleTimeout = 2 * time.Minute
+
+// icapISTag identifies the state of the ICAP service. Clients that cache
+// adapted responses use it to tell when the filtering may have changed.
+var icapISTag = fmt.Sprintf(`"redwood-%x"`, time.Now().Unix())
+
+func runICAPServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-shutdownChan
+		ln.Close()
+	}()
+
+	ln = tcpKeepAliveListener{ln.(*net.TCPListener)}
+
+	var tempDelay time.Duration
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go handleICAPConnection(conn)
+	}
+}
+
+func handleICAPConnection(conn net.Conn) {
+	activeConnections.Add(1)
+	defer activeConnections.Done()
+
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("ICAP: panic serving connection from %v: %v\n%s", conn.RemoteAddr(), err, buf)
+		}
+		Lce(conn.Close())
+	}()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	tr := textproto.NewReader(br)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(icapIdleTimeout))
+		line, err := tr.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tr.ReadMIMEHeader()
+		if err != nil {
+			logVerbose("icap", "Error reading ICAP request header from %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "ICAP/") {
+			writeICAPStatus(bw, 400, "Bad Request")
+			bw.Flush()
+			return
+		}
+
+		req := &icapRequest{
+			Method: fields[0],
+			Header: header,
+			br:     br,
+			bw:     bw,
+		}
+		switch req.Method {
+		case "OPTIONS":
+			fmt.Fprintf(bw, "ICAP/1.0 200 OK\r\nISTag: %s\r\nMethods: REQMOD, RESPMOD\r\nService: Redwood\r\nAllow: 204\r\nPreview: 0\r\nTransfer-Preview: *\r\nOptions-TTL: 3600\r\nEncapsulated: null-body=0\r\n\r\n", icapISTag)
+		case "REQMOD", "RESPMOD":
+			err = req.serve()
+		default:
+			writeICAPStatus(bw, 501, "Method Not Implemented")
+		}
+
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			logVerbose("icap", "Error handling ICAP %s request from %v: %v", req.Method, conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// writeICAPStatus writes an ICAP response with no encapsulated message.
+func writeICAPStatus(bw *bufio.Writer, status int, text string) {
+	fmt.Fprintf(bw, "ICAP/1.0 %d %s\r\nISTag: %s\r\nEncapsulated: null-body=0\r\n\r\n", status, text, icapISTag)
+}
+
+// An icapRequest is a REQMOD or RESPMOD request that is being handled by
+// the ICAP server.
+type icapRequest struct {
+	Method string
+	Header textproto.MIMEHeader
+
+	// Request and Response are the encapsulated HTTP messages. (Response is
+	// nil for REQMOD.)
+	Request  *http.Request
+	Response *http.Response
+
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	// body reads the encapsulated message body. It is nil if there is none.
+	body *icapChunkedReader
+
+	// preview is the data that was sent as a preview.
+	preview []byte
+
+	// waiting is whether the client has sent a preview, and is waiting for a
+	// 100 Continue response before sending the rest of the body.
+	waiting bool
+}
+
+func (ir *icapRequest) serve() error {
+	var hasBody bool
+	for _, part := range strings.Split(ir.Header.Get("Encapsulated"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		var err error
+		switch name {
+		case "req-hdr":
+			ir.Request, err = http.ReadRequest(ir.br)
+			if err == nil {
+				// The body (if any) is read separately, since it is chunked.
+				ir.Request.Body = http.NoBody
+			}
+		case "res-hdr":
+			ir.Response, err = http.ReadResponse(ir.br, ir.Request)
+			if err == nil {
+				ir.Response.Body = http.NoBody
+			}
+		case "req-body", "res-body":
+			hasBody = true
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing encapsulated %s: %v", name, err)
+		}
+	}
+
+	if ir.Request == nil {
+		return errors.New("no encapsulated HTTP request")
+	}
+	if ir.Method == "RESPMOD" && ir.Response == nil {
+		return errors.New("no encapsulated HTTP response in RESPMOD request")
+	}
+
+	if hasBody {
+		ir.body = &icapChunkedReader{br: ir.br}
+		if ir.Header.Get("Preview") != "" {
+			var err error
+			ir.preview, err = io.ReadAll(ir.body)
+			if err != nil {
+				return fmt.Errorf("error reading preview: %v", err)
+			}
+			ir.waiting = !ir.body.ieof
+		}
+	}
+
+	r := ir.Request
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
+	}
+	if r.URL.Scheme == "" && r.Method != "CONNECT" {
+		r.URL.Scheme = "http"
+	}
+
+	client := ir.Header.Get("X-Client-IP")
+	if client != "" {
+		r.RemoteAddr = net.JoinHostPort(client, "0")
+	}
+	authUser := icapClientUser(ir.Header)
+	if authUser == "" && client != "" {
+		authUser = anonymousUser(client)
+	}
+	user := client
+	if authUser != "" {
+		user = authUser
+	}
+
+	if ir.Method == "REQMOD" && ir.body != nil && getConfig().ACLs.scansUploads() {
+		// The body is needed for block-upload rules.
+		r.Body = io.NopCloser(ir.fullBody())
+	}
+
+	request := &Request{
+		Request:  r,
+		User:     authUser,
+		ClientIP: client,
+	}
+	filterRequest(request, false)
+	r = request.Request
+
+	if ir.Method == "REQMOD" {
+		// scanUpload may have replaced the body with one that starts with
+		// the part it read.
+		ir.Request.Body = r.Body
+		return ir.serveREQMOD(request, user)
+	}
+	return ir.serveRESPMOD(request, user)
+}
+
+func (ir *icapRequest) serveREQMOD(request *Request, user string) error {
+	r := request.Request
+	tally, scores := request.Tally, request.Scores.data
+	if request.Action.Action == "block-upload" {
+		tally, scores = request.UploadTally, request.UploadScores
+	}
+
+	switch request.Action.Action {
+	case "block", "block-invisible", "block-upload":
+		// Allowed requests are logged when their responses come back
+		// through RESPMOD, so only blocked ones are logged here.
+		logAccess(r, nil, 0, false, user, tally, scores, request.Action, "", request.Ignored)
+		if err := ir.discardBody(); err != nil {
+			return err
+		}
+		rec := httptest.NewRecorder()
+		if request.Action.Action != "block-invisible" {
+			showBlockPage(rec, r, nil, user, tally, scores, request.Action)
+		} else {
+			showInvisibleBlock(rec)
+		}
+		return ir.writeResponse(rec.Result())
+	}
+
+	return ir.writeUnmodified()
+}
+
+func (ir *icapRequest) serveRESPMOD(request *Request, user string) error {
+	r := request.Request
+	resp := ir.Response
+
+	response := &Response{
+		Request:  request,
+		Response: resp,
+	}
+	response.Scores = request.Scores
+	response.Tally = make(map[rule]int)
+	for k, v := range request.Tally {
+		response.Tally[k] = v
+	}
+
+	conf := getConfig()
+	bodyRead := false
+	if ir.body != nil && conf.ACLs.inspectsDownloads() {
+		// Download inspection needs the content.
+		resp.Body = io.NopCloser(ir.fullBody())
+		bodyRead = true
+	}
+	response.ACLs.data = unionACLSets(request.ACLs.data, conf.ACLs.responseACLs(resp))
+
+	var scanAction ACLActionRule
+	switch request.Action.Action {
+	case "block", "block-invisible":
+		// The request was blocked, so the content doesn't matter.
+	default:
+		var possibleActions []string
+		if r.Method != "HEAD" && ir.body != nil {
+			possibleActions = append(possibleActions, "hash-image", "phrase-scan")
+		}
+		scanAction, _ = conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, possibleActions...)
+		if len(conf.FileHashes) > 0 && conf.MaxHashSize > 0 && r.Method != "HEAD" && ir.body != nil && !bodyRead {
+			// The body needs to be hashed (as it is sent back, or before
+			// filtering if there are allowed hashes).
+			resp.Body = io.NopCloser(ir.fullBody())
+			bodyRead = true
+		}
+	}
+
+	if scanAction.Action != "" && !bodyRead {
+		resp.Body = io.NopCloser(ir.fullBody())
+		bodyRead = true
+	}
+
+	switch scanAction.Action {
+	case "phrase-scan":
+		if err := doPhraseScan(response); err != nil {
+			return err
+		}
+	case "hash-image":
+		if err := doImageHash(response); err != nil {
+			return err
+		}
+	}
+
+	response.Scores.data = conf.categoryScores(response.Tally)
+	if request.Action.Action == "block" || request.Action.Action == "block-invisible" {
+		response.Action = request.Action
+	} else {
+		hashBeforeFiltering(response)
+		response.PossibleActions = []string{"allow", "block", "block-invisible"}
+		filterResponse(response)
+		response.chooseAction()
+		if response.Action.Action == "allow" {
+			startHashing(response)
+		}
+	}
+
+	if sb, ok := response.Response.Body.(scanningBody); ok && response.Action.Action == "allow" {
+		// The page is too big to buffer, so it is scanned as it is sent back.
+		return ir.copyScanningBody(response, sb, user)
+	}
+
+	length := resp.ContentLength
+	if length < 0 {
+		length = 0
+	}
+	logAccess(r, resp, length, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored)
+
+	switch response.Action.Action {
+	case "block", "block-invisible":
+		if err := ir.discardBody(); err != nil {
+			return err
+		}
+		rec := httptest.NewRecorder()
+		if response.Action.Action == "block" {
+			showBlockPage(rec, r, resp, user, response.Tally, response.Scores.data, response.Action)
+		} else {
+			showInvisibleBlock(rec)
+		}
+		return ir.writeResponse(rec.Result())
+	}
+
+	if response.Modified {
+		if err := ir.discardBody(); err != nil {
+			return err
+		}
+		return ir.writeResponse(response.Response)
+	}
+	if bodyRead && !ir.allow204() {
+		// The body has been (at least partly) read, so it must be sent back.
+		return ir.writeResponse(response.Response)
+	}
+	return ir.writeUnmodified()
+}
+
+// copyScanningBody sends a response whose body is checked while it is being
+// copied (a scanningBody) back to the client. If it is blocked before any of
+// it has been sent, the client gets a block page instead; if it is blocked
+// partway through, the ICAP connection is closed, so that the client can
+// tell that the response is incomplete.
+func (ir *icapRequest) copyScanningBody(response *Response, sb scanningBody, user string) error {
+	r := response.Request.Request
+	resp := response.Response
+	w := &icapResponseWriter{ir: ir, header: make(http.Header)}
+	n, blockRule, err := sb.copyTo(w)
+	if err != nil {
+		logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored)
+		return err
+	}
+
+	switch {
+	case blockRule.Action == "":
+		logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored)
+		return w.finish()
+
+	case !w.wroteHeader:
+		logAccess(r, resp, 0, response.Modified, user, response.Tally, response.Scores.data, blockRule, response.PageTitle, response.Ignored)
+		if err := ir.discardBody(); err != nil {
+			return err
+		}
+		rec := httptest.NewRecorder()
+		if blockRule.Action == "block" {
+			showBlockPage(rec, r, resp, user, response.Tally, response.Scores.data, blockRule)
+		} else {
+			showInvisibleBlock(rec)
+		}
+		return ir.writeResponse(rec.Result())
+
+	default:
+		logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, blockRule, response.PageTitle, response.Ignored)
+		return fmt.Errorf("response from %v was blocked after part of it was sent", r.URL)
+	}
+}
+
+// An icapResponseWriter is an http.ResponseWriter that sends the response
+// to the ICAP client as the encapsulated result of a RESPMOD request.
+type icapResponseWriter struct {
+	ir          *icapRequest
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *icapResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *icapResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	var hdr strings.Builder
+	fmt.Fprintf(&hdr, "HTTP/1.1 %03d %s\r\n", status, http.StatusText(status))
+	// The ICAP client manages its own connection to the HTTP client.
+	w.header.Del("Connection")
+	w.header.Write(&hdr)
+	hdr.WriteString("\r\n")
+	w.ir.writeEncapsulatedHeader("res-hdr", hdr.String(), "res-body")
+}
+
+func (w *icapResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	writeICAPChunk(w.ir.bw, p)
+	return len(p), nil
+}
+
+func (w *icapResponseWriter) Flush() {
+	w.ir.bw.Flush()
+}
+
+// finish ends the encapsulated body.
+func (w *icapResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, err := w.ir.bw.WriteString("0\r\n\r\n")
+	return err
+}
+
+// fullBody returns a Reader for the whole encapsulated body, asking the
+// client to send the rest of it if only a preview has been received.
+func (ir *icapRequest) fullBody() io.Reader {
+	if ir.body == nil {
+		return http.NoBody
+	}
+	if !ir.waiting {
+		return io.MultiReader(bytes.NewReader(ir.preview), ir.body)
+	}
+	ir.waiting = false
+	ir.bw.WriteString("ICAP/1.0 100 Continue\r\n\r\n")
+	if err := ir.bw.Flush(); err != nil {
+		return errorReader{err}
+	}
+	ir.body.continueBody()
+	return io.MultiReader(bytes.NewReader(ir.preview), ir.body)
+}
+
+// discardBody reads and discards the rest of the encapsulated body (unless
+// the client is still waiting for a response to a preview, in which case it
+// won't send it).
+func (ir *icapRequest) discardBody() error {
+	if ir.body == nil || ir.waiting {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, ir.body)
+	return err
+}
+
+// allow204 returns whether the client will accept a 204 No Content response
+// after sending the whole message.
+func (ir *icapRequest) allow204() bool {
+	for _, a := range strings.Split(ir.Header.Get("Allow"), ",") {
+		if strings.TrimSpace(a) == "204" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeUnmodified tells the client that the message doesn't need to be
+// modified: with a 204 response if possible, or else by sending the message
+// back.
+func (ir *icapRequest) writeUnmodified() error {
+	if ir.waiting || ir.allow204() {
+		if err := ir.discardBody(); err != nil {
+			return err
+		}
+		writeICAPStatus(ir.bw, 204, "No Content")
+		return nil
+	}
+
+	if ir.Method == "REQMOD" {
+		if ir.Request.Body != http.NoBody {
+			// The body has already been read, for scanUpload.
+			return ir.writeRequest(ir.Request, ir.Request.Body)
+		}
+		return ir.writeRequest(ir.Request, ir.fullBody())
+	}
+	ir.Response.Body = io.NopCloser(ir.fullBody())
+	return ir.writeResponse(ir.Response)
+}
+
+// writeResponse sends resp to the client, as the result of the ICAP
+// request.
+func (ir *icapRequest) writeResponse(resp *http.Response) error {
+	var hdr strings.Builder
+	statusText := http.StatusText(resp.StatusCode)
+	fmt.Fprintf(&hdr, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, statusText)
+	h := resp.Header.Clone()
+	h.Del("Content-Length")
+	if resp.ContentLength >= 0 && resp.Body != nil {
+		h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	h.Write(&hdr)
+	hdr.WriteString("\r\n")
+
+	var body io.Reader
+	if resp.Body != nil && resp.Body != http.NoBody {
+		body = resp.Body
+	}
+	return ir.writeEncapsulated("res-hdr", hdr.String(), "res-body", body)
+}
+
+// writeRequest sends req to the client, as the result of a REQMOD request.
+func (ir *icapRequest) writeRequest(req *http.Request, body io.Reader) error {
+	var hdr strings.Builder
+	fmt.Fprintf(&hdr, "%s %s HTTP/1.1\r\n", req.Method, req.URL)
+	fmt.Fprintf(&hdr, "Host: %s\r\n", req.Host)
+	req.Header.Write(&hdr)
+	hdr.WriteString("\r\n")
+
+	if ir.body == nil {
+		body = nil
+	}
+	return ir.writeEncapsulated("req-hdr", hdr.String(), "req-body", body)
+}
+
+// writeEncapsulatedHeader writes the ICAP response header and the
+// encapsulated HTTP header, hdr.
+func (ir *icapRequest) writeEncapsulatedHeader(hdrName, hdr, bodyName string) {
+	fmt.Fprintf(ir.bw, "ICAP/1.0 200 OK\r\nISTag: %s\r\nEncapsulated: %s=0, %s=%d\r\n\r\n", icapISTag, hdrName, bodyName, len(hdr))
+	ir.bw.WriteString(hdr)
+}
+
+func (ir *icapRequest) writeEncapsulated(hdrName, hdr, bodyName string, body io.Reader) error {
+	if body == nil {
+		bodyName = "null-body"
+	}
+	bw := ir.bw
+	ir.writeEncapsulatedHeader(hdrName, hdr, bodyName)
+	if body == nil {
+		return nil
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		writeICAPChunk(bw, buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := bw.WriteString("0\r\n\r\n")
+	return err
+}
+
+// icapClientUser returns the username that an ICAP client sent, from the
+// X-Client-Username header (as sent by Squid), or X-Authenticated-User
+// (base64-encoded, with a prefix such as Local:// or WinNT://DOMAIN/).
+func icapClientUser(h textproto.MIMEHeader) string {
+	if u := h.Get("X-Client-Username"); u != "" {
+		return u
+	}
+	encoded := h.Get("X-Authenticated-User")
+	if encoded == "" {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	u := string(decoded)
+	if i := strings.Index(u, "://"); i != -1 {
+		u = u[i+3:]
+	}
+	if i := strings.LastIndex(u, "/"); i != -1 {
+		u = u[i+1:]
+	}
+	return u
+}
+
+// An icapChunkedReader reads an encapsulated message body in chunked
+// encoding, keeping track of whether the final chunk had the ieof extension
+// (meaning the preview contained the whole body).
+type icapChunkedReader struct {
+	br        *bufio.Reader
+	remaining int64
+	eof       bool
+	ieof      bool
+}
+
+func (cr *icapChunkedReader) Read(p []byte) (n int, err error) {
+	for cr.remaining == 0 {
+		if cr.eof {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err = cr.br.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if cr.remaining == 0 && err == nil {
+		// the CRLF after the chunk data
+		var line string
+		line, err = cr.br.ReadString('\n')
+		if err == nil && strings.TrimRight(line, "\r\n") != "" {
+			err = errors.New("malformed chunked encoding")
+		}
+	}
+	return n, err
+}
+
+func (cr *icapChunkedReader) nextChunk() error {
+	line, err := cr.br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid chunk size %q", size)
+	}
+	if n > 0 {
+		cr.remaining = n
+		return nil
+	}
+
+	cr.eof = true
+	cr.ieof = strings.TrimSpace(ext) == "ieof"
+	// Skip the trailer.
+	for {
+		line, err := cr.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+	}
+}
+
+// continueBody prepares to read the rest of the body after a preview.
+func (cr *icapChunkedReader) continueBody() {
+	if !cr.ieof {
+		cr.eof = false
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
@@ -103,10 +103,19 @@ type rangeToGroup struct {
 	group string
 }
 
-// An IPMap maps IP addresses and ranges to ACL names.
+// An IPMap maps IP addresses and ranges to ACL names. It can also map
+// countries and autonomous systems (looked up in the GeoIP databases) to ACL
+// names.
 type IPMap struct {
 	addresses map[string][]string
 	ranges    []rangeToGroup
+	countries map[string][]string
+	asns      map[uint][]string
+}
+
+// empty returns whether m has no mappings.
+func (m *IPMap) empty() bool {
+	return len(m.addresses) == 0 && len(m.ranges) == 0 && len(m.countries) == 0 && len(m.asns) == 0
 }
 
 // add adds an address/ACL mapping.
@@ -127,6 +136,33 @@ func (m *IPMap) add(addr, acl string) error {
 	return nil
 }
 
+// addCountry adds a country/ACL mapping. The country is an ISO 3166 code,
+// like US or CN.
+func (m *IPMap) addCountry(country, acl string) error {
+	if len(country) != 2 {
+		return fmt.Errorf("invalid country code: %s", country)
+	}
+	if m.countries == nil {
+		m.countries = make(map[string][]string)
+	}
+	country = strings.ToUpper(country)
+	m.countries[country] = append(m.countries[country], acl)
+	return nil
+}
+
+// addASN adds an autonomous system/ACL mapping.
+func (m *IPMap) addASN(asn, acl string) error {
+	n, err := parseASN(asn)
+	if err != nil {
+		return err
+	}
+	if m.asns == nil {
+		m.asns = make(map[uint][]string)
+	}
+	m.asns[n] = append(m.asns[n], acl)
+	return nil
+}
+
 // matches returns a list of the ACLs that addr belongs to.
 func (m *IPMap) matches(addr net.IP) (result []string) {
 	result = append(result, m.addresses[addr.String()]...)
@@ -135,5 +171,19 @@ func (m *IPMap) matches(addr net.IP) (result []string) {
 			result = append(result, r.group)
 		}
 	}
+
+	if len(m.countries) > 0 || len(m.asns) > 0 {
+		conf := getConfig()
+		if len(m.countries) > 0 {
+			if country := conf.ipCountry(addr); country != "" {
+				result = append(result, m.countries[country]...)
+			}
+		}
+		if len(m.asns) > 0 {
+			if asn := conf.ipASN(addr); asn != 0 {
+				result = append(result, m.asns[asn]...)
+			}
+		}
+	}
 	return result
 }
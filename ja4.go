@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// JA4 and JA4S TLS fingerprints, and other information from TLS hello messages.
+// See https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+
+const extensionEncryptedClientHello = 0xfe0d
+
+// A clientHelloInfo is the information that parseClientHello extracts from
+// a ClientHello message.
+type clientHelloInfo struct {
+	tls.ClientHelloInfo
+
+	// Version is the legacy_version field of the ClientHello.
+	Version uint16
+
+	// Extensions lists the extension types, in the order they were sent.
+	Extensions []uint16
+
+	// KeyShares lists the groups that the client sent key shares for.
+	KeyShares []tls.CurveID
+
+	// ECH is whether the encrypted_client_hello extension was present.
+	ECH bool
+}
+
+type clientHelloKey struct{}
+
+// isGREASE returns whether v is one of the reserved values that clients
+// send to keep servers from being intolerant of unknown values (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// postQuantumGroups are the key exchange groups that include a
+// post-quantum key encapsulation mechanism.
+var postQuantumGroups = map[tls.CurveID]bool{
+	0x0200: true, // MLKEM512
+	0x0201: true, // MLKEM768
+	0x0202: true, // MLKEM1024
+	0x11eb: true, // SecP256r1MLKEM768
+	0x11ec: true, // X25519MLKEM768
+	0x11ed: true, // SecP384r1MLKEM1024
+	0x6399: true, // X25519Kyber768Draft00
+	0x639a: true, // SecP256r1Kyber768Draft00
+}
+
+// PostQuantum returns whether the client sent a post-quantum key share.
+func (h *clientHelloInfo) PostQuantum() bool {
+	for _, g := range h.KeyShares {
+		if postQuantumGroups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// OfferedVersions returns the TLS versions the client supports, from the
+// supported_versions extension if present, or else from the legacy version
+// field.
+func (h *clientHelloInfo) OfferedVersions() []uint16 {
+	if len(h.SupportedVersions) == 0 {
+		return []uint16{h.Version}
+	}
+	var result []uint16
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// TLSVersions returns the names of the TLS versions the client supports,
+// such as "1.3".
+func (h *clientHelloInfo) TLSVersions() []string {
+	var result []string
+	for _, v := range h.OfferedVersions() {
+		result = append(result, tlsVersionName(v))
+	}
+	return result
+}
+
+// CipherSuiteNames returns the names of the cipher suites the client
+// offered, omitting GREASE values.
+func (h *clientHelloInfo) CipherSuiteNames() []string {
+	var result []string
+	for _, c := range h.CipherSuites {
+		if !isGREASE(c) {
+			result = append(result, tls.CipherSuiteName(c))
+		}
+	}
+	return result
+}
+
+// Features returns a list of notable things about the ClientHello, for
+// logging.
+func (h *clientHelloInfo) Features() []string {
+	var result []string
+	if h.ECH {
+		result = append(result, "ech")
+	}
+	if h.PostQuantum() {
+		result = append(result, "post-quantum")
+	}
+	return result
+}
+
+// tlsVersionName returns the name of a TLS version, in the form used by the
+// tls-version ACL.
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "1.3"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS10:
+		return "1.0"
+	case 0x0300:
+		return "ssl3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// ja4Version returns the two-character version code used in JA4 fingerprints.
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the two-character code for an ALPN protocol: its first and
+// last characters, or "00" if there is none.
+func ja4ALPN(proto string) string {
+	if proto == "" {
+		return "00"
+	}
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(proto))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 hash of s, or a
+// string of zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// hexList formats a list of 16-bit values as comma-separated hex numbers,
+// omitting GREASE values.
+func hexList(values []uint16) string {
+	var parts []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, fmt.Sprintf("%04x", v))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello.
+func (h *clientHelloInfo) JA4() string {
+	version := uint16(0)
+	for _, v := range h.OfferedVersions() {
+		if v > version {
+			version = v
+		}
+	}
+
+	sni := "i"
+	for _, e := range h.Extensions {
+		if e == 0 {
+			sni = "d"
+		}
+	}
+
+	var ciphers []uint16
+	for _, c := range h.CipherSuites {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, c)
+		}
+	}
+
+	var extensionCount int
+	var sortedExtensions []uint16
+	for _, e := range h.Extensions {
+		if isGREASE(e) {
+			continue
+		}
+		extensionCount++
+		if e != 0 && e != 16 {
+			// SNI and ALPN are left out of the hash, since they are
+			// already represented in the first section.
+			sortedExtensions = append(sortedExtensions, e)
+		}
+	}
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+
+	alpn := ""
+	if len(h.SupportedProtos) > 0 {
+		alpn = h.SupportedProtos[0]
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, min99(len(ciphers)), min99(extensionCount), ja4ALPN(alpn))
+
+	c := ""
+	if len(sortedExtensions) > 0 {
+		c = hexList(sortedExtensions)
+		var sigAlgs []uint16
+		for _, s := range h.SignatureSchemes {
+			sigAlgs = append(sigAlgs, uint16(s))
+		}
+		if s := hexList(sigAlgs); s != "" {
+			c += "_" + s
+		}
+	}
+
+	return a + "_" + ja4Hash(hexList(ciphers)) + "_" + ja4Hash(c)
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+// ja4s calculates the JA4S fingerprint of a ServerHello message (including
+// the four-byte handshake message header).
+func ja4s(serverHello []byte) (string, error) {
+	s := cryptobyte.String(serverHello)
+
+	var msgType uint8
+	var version, cipherSuite uint16
+	var sessionID cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 2 || !s.Skip(3) ||
+		!s.ReadUint16(&version) || !s.Skip(32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16(&cipherSuite) || !s.Skip(1) {
+		return "", errors.New("malformed ServerHello")
+	}
+
+	var extensionTypes []uint16
+	alpn := ""
+	if !s.Empty() {
+		var extensions cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&extensions) {
+			return "", errors.New("malformed ServerHello extensions")
+		}
+		for !extensions.Empty() {
+			var extension uint16
+			var extData cryptobyte.String
+			if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+				return "", errors.New("malformed ServerHello extension")
+			}
+			extensionTypes = append(extensionTypes, extension)
+
+			switch extension {
+			case 43: // supported versions
+				extData.ReadUint16(&version)
+			case 16: // ALPN
+				var protoList, proto cryptobyte.String
+				if extData.ReadUint16LengthPrefixed(&protoList) && protoList.ReadUint8LengthPrefixed(&proto) {
+					alpn = string(proto)
+				}
+			}
+		}
+	}
+
+	a := fmt.Sprintf("t%s%02d%s", ja4Version(version), min99(len(extensionTypes)), ja4ALPN(alpn))
+	return fmt.Sprintf("%s_%04x_%s", a, cipherSuite, ja4Hash(hexList(extensionTypes))), nil
+}
+
+// A serverHelloRecorder is a net.Conn that saves the beginning of the data
+// it reads, so that the ServerHello message can be extracted after the
+// handshake is complete.
+type serverHelloRecorder struct {
+	net.Conn
+	data    []byte
+	stopped bool
+}
+
+// maxRecordedHandshake is the maximum amount of data that a
+// serverHelloRecorder saves.
+const maxRecordedHandshake = 0x5000
+
+func (c *serverHelloRecorder) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if !c.stopped && n > 0 {
+		c.data = append(c.data, p[:n]...)
+		if len(c.data) >= maxRecordedHandshake {
+			c.stopped = true
+		}
+	}
+	return n, err
+}
+
+// ServerHello stops recording, and returns the ServerHello message from the
+// recorded data.
+func (c *serverHelloRecorder) ServerHello() ([]byte, error) {
+	data := c.data
+	c.data = nil
+	c.stopped = true
+
+	// Collect the contents of the handshake records until there is a
+	// complete message.
+	var handshake []byte
+	for len(data) >= 5 {
+		recordType := data[0]
+		recordLen := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+recordLen {
+			break
+		}
+		if recordType != 22 {
+			break
+		}
+		handshake = append(handshake, data[5:5+recordLen]...)
+		data = data[5+recordLen:]
+
+		if len(handshake) >= 4 {
+			msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+msgLen {
+				return handshake[:4+msgLen], nil
+			}
+		}
+	}
+	return nil, errors.New("ServerHello not found")
+}
@@ -26,6 +26,11 @@ var (
 	starlarkLog CSVLog
 )
 
+// defaultLogOutput is where logs go if no file is specified for them.
+// It is changed to standard error when standard output is being used for
+// something else.
+var defaultLogOutput = os.Stdout
+
 type CSVLog struct {
 	lock sync.Mutex
 	file *os.File
@@ -35,7 +40,7 @@ type CSVLog struct {
 func (l *CSVLog) Open(filename string) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if l.file != nil && l.file != os.Stdout {
+	if l.file != nil && l.file != defaultLogOutput {
 		l.file.Close()
 		l.file = nil
 	}
@@ -43,13 +48,13 @@ func (l *CSVLog) Open(filename string) {
 	if filename != "" {
 		logfile, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
-			log.Printf("Could not open log file (%s): %s\n Sending log messages to standard output instead.", filename, err)
+			log.Printf("Could not open log file (%s): %s\n Sending log messages to %s instead.", filename, err, defaultLogOutput.Name())
 		} else {
 			l.file = logfile
 		}
 	}
 	if l.file == nil {
-		l.file = os.Stdout
+		l.file = defaultLogOutput
 	}
 
 	l.csv = csv.NewWriter(l.file)
@@ -66,7 +71,10 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 	conf := getConfig()
 
 	modified := ""
-	if pruned {
+	switch {
+	case isStreamScanned(resp):
+		modified = "streamed"
+	case pruned:
 		modified = "pruned"
 	}
 
@@ -96,7 +104,12 @@ func logAccess(req *http.Request, resp *http.Response, contentLength int64, prun
 		title = title[:500]
 	}
 
-	logLine := toStrings(time.Now().Format("2006-01-02 15:04:05.000000"), user, rule.Action, req.URL, req.Method, status, contentType, contentLength, modified, listTally(stringTally(tally)), listTally(scores), rule.Conditions(), title, strings.Join(ignored, ","), userAgent, req.Proto, req.Referer(), platform(req.Header.Get("User-Agent")), downloadedFilename(resp), rule.Description)
+	var cacheStatus string
+	if resp != nil && conf.CacheDir != "" {
+		cacheStatus = resp.Header.Get(cacheStatusHeader)
+	}
+
+	logLine := toStrings(time.Now().Format("2006-01-02 15:04:05.000000"), user, rule.Action, req.URL, req.Method, status, contentType, contentLength, modified, listTally(stringTally(tally)), listTally(scores), rule.Conditions(), title, strings.Join(ignored, ","), userAgent, req.Proto, req.Referer(), platform(req.Header.Get("User-Agent")), downloadedFilename(resp), rule.Description, cacheStatus, responseHash(resp))
 
 	accessLog.Log(logLine)
 	return logLine
@@ -123,18 +136,18 @@ func Lce(err error) {
 	}
 }
 
-func (t TLSSession) logClose(err error, c bool, l string) {
-	t.Errorf("unable to close connection: %s", err, c, l)
+func (t TLSSession) logClose(err error, c bool) {
+	t.Errorf("unable to close connection: %s", err, c)
 }
-func (t TLSSession) Errorf(format string, err error, cachedCert bool, tlsFingerprint string) {
-	t.Error(fmt.Errorf(format, err), cachedCert, tlsFingerprint)
+func (t TLSSession) Errorf(format string, err error, cachedCert bool) {
+	t.Error(fmt.Errorf(format, err), cachedCert)
 }
 
-func (t TLSSession) Error(err error, cachedCert bool, tlsFingerprint string) {
-	logTLS(t.User, t.ServerAddr, t.SNI, err, cachedCert, tlsFingerprint)
+func (t TLSSession) Error(err error, cachedCert bool) {
+	logTLS(t.User, t.ServerAddr, t.SNI, err, cachedCert, &t)
 }
 
-func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, tlsFingerprint string) {
+func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, session *TLSSession) {
 	errStr := ""
 	if err != nil {
 		errStr = err.Error()
@@ -144,8 +157,15 @@ func logTLS(user, serverAddr, serverName string, err error, cachedCert bool, tls
 	if cachedCert {
 		cached = "cached certificate"
 	}
+
+	var versions, features string
+	if session.clientHello != nil {
+		versions = strings.Join(session.clientHello.TLSVersions(), " ")
+		features = strings.Join(session.clientHello.Features(), " ")
+	}
+
 	// "2006-01-02 15:04:05.000000"
-	tlsLog.Log(toStrings(time.Now().Format("2006.01.02::15:04:05.000000"), user, serverName, serverAddr, errStr, cached, tlsFingerprint))
+	tlsLog.Log(toStrings(time.Now().Format("2006.01.02::15:04:05.000000"), user, serverName, serverAddr, errStr, cached, session.JA3, session.JA4, session.JA4S, versions, features, session.ECHStatus))
 }
 
 func logContent(u *url.URL, content []byte, scores map[string]int) {
@@ -0,0 +1,381 @@
+package main
+
+// Text normalization for phrase scanning, to defeat common ways of hiding
+// words from filters: full-width and other compatibility characters,
+// homoglyphs from other alphabets, zero-width characters, and leetspeak.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultLeetMap is the leet map that is used if the leet-map option isn't
+// set.
+var defaultLeetMap = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'$': 's',
+}
+
+// parseLeetMap parses the value of the leet-map option: a list of mappings
+// like 0=o.
+func (conf *config) parseLeetMap(s string) error {
+	m := make(map[rune]rune)
+	for _, f := range strings.Fields(s) {
+		from, to, ok := strings.Cut(f, "=")
+		if !ok || utf8.RuneCountInString(from) != 1 || utf8.RuneCountInString(to) != 1 {
+			return fmt.Errorf("invalid leet-map entry %q (expected something like 0=o)", f)
+		}
+		r, _ := utf8.DecodeRuneInString(from)
+		m[r], _ = utf8.DecodeRuneInString(to)
+	}
+	if len(m) == 0 {
+		return errors.New("empty leet-map")
+	}
+	conf.LeetMap = m
+	return nil
+}
+
+// leetMap returns the leet map to use.
+func (conf *config) leetMap() map[rune]rune {
+	if conf.LeetMap != nil {
+		return conf.LeetMap
+	}
+	return defaultLeetMap
+}
+
+// zeroWidth reports whether r is an invisible character that can be used to
+// split up a word without changing how it looks.
+func zeroWidth(r rune) bool {
+	switch r {
+	case '\u00ad', // soft hyphen
+		'\u034f',                                         // combining grapheme joiner
+		'\u180e',                                         // Mongolian vowel separator
+		'\u200b', '\u200c', '\u200d', '\u200e', '\u200f', // zero-width space, joiners, and direction marks
+		'\u2060', '\u2061', '\u2062', '\u2063', '\u2064', // word joiner and invisible operators
+		'\ufeff': // zero-width no-break space
+		return true
+	}
+	return false
+}
+
+// latinConfusables maps letters from other alphabets to the Latin letters
+// they look like. They are only replaced in words that also contain Latin
+// letters, so that text that is really in Greek or Russian isn't changed.
+var latinConfusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i',
+	'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'ԛ': 'q', 'ѕ': 's', 'т': 't', 'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y',
+	'ё': 'e', 'ї': 'i',
+	'А': 'a', 'В': 'b', 'С': 'c', 'Е': 'e', 'Н': 'h', 'І': 'i', 'Ј': 'j',
+	'К': 'k', 'М': 'm', 'О': 'o', 'Р': 'p', 'Ѕ': 's', 'Т': 't', 'Х': 'x',
+	'У': 'y', 'Ԝ': 'w',
+
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+	'Α': 'a', 'Β': 'b', 'Ε': 'e', 'Ζ': 'z', 'Η': 'h', 'Ι': 'i', 'Κ': 'k',
+	'Μ': 'm', 'Ν': 'n', 'Ο': 'o', 'Ρ': 'p', 'Τ': 't', 'Υ': 'y', 'Χ': 'x',
+}
+
+// latinLookalikes maps unusual Latin letters to the common letters they look
+// like. They are replaced everywhere.
+var latinLookalikes = map[rune]rune{
+	'ı': 'i', 'ȷ': 'j', 'ɑ': 'a', 'ɡ': 'g', 'ʜ': 'h', 'ɪ': 'i', 'ʟ': 'l',
+	'ɴ': 'n', 'ʀ': 'r', 'ʏ': 'y', 'ᴀ': 'a', 'ʙ': 'b', 'ᴄ': 'c', 'ᴅ': 'd',
+	'ᴇ': 'e', 'ᴋ': 'k', 'ᴍ': 'm', 'ᴏ': 'o', 'ᴘ': 'p', 'ᴛ': 't', 'ᴜ': 'u',
+	'ᴠ': 'v', 'ᴡ': 'w', 'ᴢ': 'z', 'ſ': 's',
+}
+
+// maxTokenLen is the longest word that textNormalizer will hold back to
+// normalize as a unit.
+const maxTokenLen = 64
+
+// minSpacedLetters is the number of single letters in a row (like "p o r n")
+// that textNormalizer joins into a word.
+const minSpacedLetters = 3
+
+// A textNormalizer is a Transformer that applies NFKC normalization, folds
+// confusable characters and leetspeak into plain letters, removes zero-width
+// characters, and joins words that are spelled out with a space or
+// punctuation between the letters. It works a word at a time.
+type textNormalizer struct {
+	leet map[rune]rune
+
+	token    []rune // the word being collected
+	original []rune // the word as it appeared, including zero-width characters
+	pending  []byte // output that hasn't fit in dst yet
+
+	// spaced is a run of single letters, which will be joined if it gets
+	// long enough, and spacedText is the run as it appeared.
+	spaced      []rune
+	spacedText  []byte
+	afterLetter bool
+
+	// changed, if it is not nil, records the words that were changed, by
+	// their normalized form.
+	changed map[string][]string
+}
+
+func newTextNormalizer(leet map[rune]rune, changed map[string][]string) *textNormalizer {
+	return &textNormalizer{
+		leet:    leet,
+		changed: changed,
+	}
+}
+
+func (t *textNormalizer) Reset() {
+	t.token = t.token[:0]
+	t.original = t.original[:0]
+	t.pending = t.pending[:0]
+	t.spaced = t.spaced[:0]
+	t.spacedText = t.spacedText[:0]
+	t.afterLetter = false
+}
+
+// inToken reports whether r can be part of a word.
+func (t *textNormalizer) inToken(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+		return true
+	}
+	_, ok := t.leet[r]
+	return ok
+}
+
+// letterSeparator reports whether r can separate the letters of a word that
+// is spelled out.
+func letterSeparator(r rune) bool {
+	switch r {
+	case ' ', '.', '-', '_', '*', '+', '|':
+		return true
+	}
+	return false
+}
+
+func (t *textNormalizer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for {
+		if len(t.pending) > 0 {
+			n := copy(dst[nDst:], t.pending)
+			nDst += n
+			t.pending = t.pending[:copy(t.pending, t.pending[n:])]
+			if len(t.pending) > 0 {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+		}
+
+		if nSrc == len(src) {
+			if atEOF && (len(t.token) > 0 || len(t.spaced) > 0) {
+				t.flushToken()
+				t.flushSpaced()
+				continue
+			}
+			return nDst, nSrc, nil
+		}
+
+		r, n := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		nSrc += n
+
+		switch {
+		case zeroWidth(r):
+			if len(t.token) > 0 {
+				t.original = append(t.original, r)
+			}
+		case t.inToken(r):
+			if len(t.token) == maxTokenLen {
+				t.flushToken()
+			}
+			t.token = append(t.token, r)
+			t.original = append(t.original, r)
+		default:
+			t.flushToken()
+			if len(t.spaced) > 0 && t.afterLetter && letterSeparator(r) {
+				t.spacedText = utf8.AppendRune(t.spacedText, r)
+				t.afterLetter = false
+				continue
+			}
+			t.flushSpaced()
+			t.pending = utf8.AppendRune(t.pending, r)
+		}
+	}
+}
+
+// flushToken normalizes the current word, and adds it to t.pending (or to
+// t.spaced, if it is a single letter).
+func (t *textNormalizer) flushToken() {
+	if len(t.token) == 0 {
+		return
+	}
+	normalized := normalizeToken(t.token, t.leet)
+	original := string(t.original)
+	t.token = t.token[:0]
+	t.original = t.original[:0]
+
+	if len(normalized) == 1 && unicode.IsLetter(normalized[0]) && len(t.spaced) < maxTokenLen && (len(t.spaced) == 0 || !t.afterLetter) {
+		t.spaced = append(t.spaced, normalized[0])
+		t.spacedText = append(t.spacedText, original...)
+		t.afterLetter = true
+		return
+	}
+	t.flushSpaced()
+
+	start := len(t.pending)
+	for _, r := range normalized {
+		t.pending = utf8.AppendRune(t.pending, r)
+	}
+	t.recordChange(string(t.pending[start:]), original)
+}
+
+// flushSpaced adds the current run of single letters to t.pending, joining
+// them into a word if there are enough of them.
+func (t *textNormalizer) flushSpaced() {
+	if len(t.spaced) == 0 {
+		return
+	}
+	if len(t.spaced) < minSpacedLetters {
+		t.pending = append(t.pending, t.spacedText...)
+	} else {
+		text := string(t.spacedText)
+		trimmed := strings.TrimRightFunc(text, letterSeparator)
+		t.pending = append(t.pending, string(t.spaced)...)
+		t.pending = append(t.pending, text[len(trimmed):]...)
+		t.recordChange(string(t.spaced), trimmed)
+	}
+	t.spaced = t.spaced[:0]
+	t.spacedText = t.spacedText[:0]
+	t.afterLetter = false
+}
+
+// recordChange adds original to t.changed, if normalization changed it.
+func (t *textNormalizer) recordChange(normalized, original string) {
+	if t.changed == nil || len(t.changed) >= 1000 {
+		return
+	}
+	key := strings.TrimSpace(wordString(normalized))
+	if key == strings.TrimSpace(wordString(original)) {
+		return
+	}
+	if len(t.changed[key]) < 10 && !stringIn(original, t.changed[key]) {
+		t.changed[key] = append(t.changed[key], original)
+	}
+}
+
+func stringIn(s string, list []string) bool {
+	for _, s2 := range list {
+		if s == s2 {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeToken returns a normalized copy of the word in token.
+func normalizeToken(token []rune, leet map[rune]rune) []rune {
+	out := []rune(norm.NFKC.String(string(token)))
+	hasLatin, hasOther := false, false
+	for i, r := range out {
+		if l, ok := latinLookalikes[r]; ok {
+			r = l
+		}
+		out[i] = r
+		switch {
+		case r < 0x250 && unicode.IsLetter(r):
+			hasLatin = true
+		case latinConfusables[r] != 0:
+			hasOther = true
+		}
+	}
+
+	if hasLatin && hasOther {
+		for i, r := range out {
+			if l, ok := latinConfusables[r]; ok {
+				out[i] = l
+			}
+		}
+	}
+
+	// Replace runs of leetspeak characters that have letters on both sides.
+	// (Leetspeak characters at the beginning or end of a word are more
+	// likely to be something else, like the 3 in mp3.)
+	for i := 0; i < len(out); {
+		if _, ok := leet[out[i]]; !ok || unicode.IsLetter(out[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(out) {
+			if _, ok := leet[out[j]]; !ok || unicode.IsLetter(out[j]) {
+				break
+			}
+			j++
+		}
+		if i > 0 && j < len(out) && unicode.IsLetter(out[i-1]) && unicode.IsLetter(out[j]) {
+			for k := i; k < j; k++ {
+				out[k] = leet[out[k]]
+			}
+		}
+		i = j
+	}
+	return out
+}
+
+// normalizationTransformers returns the Transformers that normalize text, if
+// normalize-text is enabled.
+func (conf *config) normalizationTransformers(changed map[string][]string) []transform.Transformer {
+	if !conf.NormalizeText {
+		return nil
+	}
+	return []transform.Transformer{newTextNormalizer(conf.leetMap(), changed)}
+}
+
+// normalizePhrase normalizes a phrase (that has already been processed by
+// wordString) the same way the page content is normalized.
+func (conf *config) normalizePhrase(s string) string {
+	result, _, err := transform.String(conf.contentTransformer("text/plain", "utf-8", nil), s)
+	if err != nil {
+		return s
+	}
+	return result
+}
+
+// matchedText returns the original text of the words that were changed by
+// normalization and are part of the phrases that matched, indexed by rule.
+func (conf *config) matchedText(tally map[rule]int, changed map[string][]string) map[string][]string {
+	if len(changed) == 0 {
+		return nil
+	}
+	result := make(map[string][]string)
+	for r := range tally {
+		var phrases []string
+		switch r.t {
+		case contentPhrase, contentSubstring:
+			phrases = []string{r.content}
+		case combinationRule:
+			phrases = splitCombination(r.content).phrases
+		default:
+			continue
+		}
+		for _, p := range phrases {
+			p = " " + conf.normalizePhrase(p) + " "
+			for word, originals := range changed {
+				if word != "" && strings.Contains(p, " "+word+" ") {
+					result[r.String()] = append(result[r.String()], originals...)
+				}
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,215 @@
+package main
+
+// Extracting the text from Office Open XML (.docx, .pptx, .xlsx) and
+// OpenDocument (.odt, .odp, .ods) files, so that they can be phrase-scanned.
+// Both formats are ZIP archives of XML files.
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// officeTextParts lists the parts of an Office Open XML package that contain
+// document text, slide text, shared strings, and comments.
+var officeTextParts = []string{
+	"word/document.xml",
+	"word/comments.xml",
+	"word/footnotes.xml",
+	"word/endnotes.xml",
+	"word/header*.xml",
+	"word/footer*.xml",
+	"ppt/slides/slide*.xml",
+	"ppt/notesSlides/notesSlide*.xml",
+	"ppt/comments/*.xml",
+	"xl/sharedStrings.xml",
+	"xl/worksheets/sheet*.xml",
+	"xl/comments*.xml",
+	"xl/threadedComments/*.xml",
+}
+
+// openDocumentTextParts lists the parts of an OpenDocument package that
+// contain text. (Comments are stored inline, as annotations.)
+var openDocumentTextParts = []string{
+	"content.xml",
+	"styles.xml",
+}
+
+// extractOfficeText returns the text from an Office Open XML or OpenDocument
+// file, up to maxLen bytes. If content is some other kind of ZIP file, it
+// returns nil.
+func extractOfficeText(content []byte, maxLen int) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var patterns []string
+	var textElement func(name xml.Name) bool
+	switch {
+	case files["[Content_Types].xml"] != nil:
+		patterns = officeTextParts
+		// In Office Open XML, the text is in <w:t>, <a:t>, or <t> elements
+		// (and <text> for comments); other character data is formatting
+		// or numbers.
+		textElement = func(name xml.Name) bool {
+			return name.Local == "t" || name.Local == "text"
+		}
+	case files["mimetype"] != nil && files["content.xml"] != nil:
+		patterns = openDocumentTextParts
+		textElement = func(name xml.Name) bool {
+			return true
+		}
+	default:
+		return nil
+	}
+
+	var parts []*zip.File
+	for _, f := range zr.File {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, f.Name); ok {
+				parts = append(parts, f)
+				break
+			}
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		return partIndex(parts[i].Name, patterns) < partIndex(parts[j].Name, patterns)
+	})
+
+	x := &xmlTextExtractor{
+		maxLen:      maxLen,
+		budget:      int64(20 * maxLen),
+		textElement: textElement,
+	}
+	for _, f := range parts {
+		if x.full() || x.budget <= 0 {
+			break
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		x.extract(rc)
+		rc.Close()
+	}
+	return x.out.Bytes()
+}
+
+// partIndex returns the index of the first pattern that name matches, so
+// that the parts can be put in a sensible order (document text first).
+func partIndex(name string, patterns []string) int {
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return i
+		}
+	}
+	return len(patterns)
+}
+
+// An xmlTextExtractor collects the text from XML documents.
+type xmlTextExtractor struct {
+	out    bytes.Buffer
+	maxLen int
+
+	// budget is how many more bytes may be decompressed.
+	budget int64
+
+	// textElement reports whether the character data in an element is
+	// document text.
+	textElement func(name xml.Name) bool
+}
+
+func (x *xmlTextExtractor) full() bool {
+	return x.out.Len() >= x.maxLen
+}
+
+func (x *xmlTextExtractor) write(s string) {
+	if room := x.maxLen - x.out.Len(); len(s) > room {
+		s = s[:room]
+	}
+	x.out.WriteString(s)
+}
+
+// space separates the text from what comes next, unless it is already
+// separated.
+func (x *xmlTextExtractor) space() {
+	if n := x.out.Len(); n > 0 {
+		if last := x.out.Bytes()[n-1]; last != ' ' && last != '\n' {
+			x.write(" ")
+		}
+	}
+}
+
+// breakElements are the elements that separate words: paragraphs, line
+// breaks, tabs, and table cells. Other elements (such as the runs of text
+// in a .docx file) may split a word.
+var breakElements = map[string]bool{
+	"p":          true, // paragraph (OOXML and ODF)
+	"h":          true, // heading (ODF)
+	"br":         true,
+	"cr":         true,
+	"tab":        true,
+	"s":          true, // space (ODF)
+	"line-break": true,
+	"tc":         true, // table cell (OOXML)
+	"table-cell": true,
+	"list-item":  true,
+	"si":         true, // shared string item (OOXML)
+	"c":          true, // spreadsheet cell (OOXML)
+	"comment":    true,
+	"annotation": true,
+}
+
+func (x *xmlTextExtractor) extract(r io.Reader) {
+	lr := &io.LimitedReader{R: r, N: x.budget}
+	defer func() {
+		x.budget = lr.N
+	}()
+
+	d := xml.NewDecoder(lr)
+	d.Strict = false
+	inText := 0
+
+	for !x.full() {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if breakElements[t.Name.Local] {
+				x.space()
+			}
+			if inText > 0 || x.textElement(t.Name) {
+				inText++
+			}
+		case xml.EndElement:
+			if inText > 0 {
+				inText--
+			}
+			if breakElements[t.Name.Local] {
+				x.space()
+			}
+		case xml.CharData:
+			if inText > 0 {
+				x.write(strings.Map(func(r rune) rune {
+					if r == '\n' || r == '\r' || r == '\t' {
+						return ' '
+					}
+					return r
+				}, string(t)))
+			}
+		}
+	}
+	x.space()
+}
@@ -0,0 +1,1037 @@
+package main
+
+// Extracting the text from PDF files, so that they can be phrase-scanned.
+//
+// This is not a complete PDF parser; it finds the objects by scanning for
+// "N G obj" (instead of reading the cross-reference table), decodes the
+// content streams of the pages, and interprets the text-showing operators.
+// Encrypted files are not supported.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+type (
+	pdfName    string
+	pdfString  string
+	pdfKeyword string
+	pdfArray   []interface{}
+	pdfDict    map[pdfName]interface{}
+)
+
+type pdfRef struct {
+	num, gen int
+}
+
+// A pdfStream is a stream object: a dictionary, followed by (usually
+// compressed) data.
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+// extractPDFText returns the text from a PDF file, up to maxLen bytes.
+func extractPDFText(content []byte, maxLen int) []byte {
+	doc := newPDFDocument(content, 20*maxLen)
+	if doc.encrypted() {
+		return nil
+	}
+	e := &pdfTextExtractor{
+		doc:     doc,
+		maxLen:  maxLen,
+		visited: make(map[int]bool),
+	}
+
+	foundPages := false
+	for _, num := range doc.objectNumbers() {
+		dict, ok := doc.object(num).(pdfDict)
+		if !ok || dict["Type"] != pdfName("Page") {
+			continue
+		}
+		foundPages = true
+		resources := doc.pageResources(dict)
+		for _, c := range doc.contentStreams(dict["Contents"]) {
+			e.extract(doc.decode(c), resources, 0)
+		}
+		if e.full() {
+			break
+		}
+	}
+
+	if !foundPages {
+		// Maybe the page tree is damaged; try any stream that looks like
+		// page content.
+		for _, num := range doc.objectNumbers() {
+			s, ok := doc.object(num).(*pdfStream)
+			if !ok {
+				continue
+			}
+			data := doc.decode(s)
+			if bytes.Contains(data, []byte("BT")) && bytes.Contains(data, []byte("ET")) {
+				e.extract(data, nil, 0)
+			}
+			if e.full() {
+				break
+			}
+		}
+	}
+
+	return e.out.Bytes()
+}
+
+// A pdfLexer splits PDF data into tokens.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// token returns the next token: a simple value (number, string, name, bool,
+// or nil), or a pdfKeyword (which includes the delimiters "[", "]", "<<",
+// and ">>"). It returns false at the end of the data.
+func (l *pdfLexer) token() (interface{}, bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, false
+	}
+
+	c := l.data[l.pos]
+	switch c {
+	case '(':
+		l.pos++
+		return l.literalString(), true
+	case '<':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '<' {
+			l.pos += 2
+			return pdfKeyword("<<"), true
+		}
+		l.pos++
+		return l.hexString(), true
+	case '>':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return pdfKeyword(">>"), true
+		}
+		l.pos++
+		return pdfKeyword(">"), true
+	case '[', ']', '{', '}', ')':
+		l.pos++
+		return pdfKeyword(c), true
+	case '/':
+		l.pos++
+		return l.name(), true
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	word := string(l.data[start:l.pos])
+	switch word {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "null":
+		return nil, true
+	}
+	if strings.IndexByte("+-.0123456789", word[0]) != -1 {
+		if f, err := strconv.ParseFloat(word, 64); err == nil {
+			return f, true
+		}
+	}
+	return pdfKeyword(word), true
+}
+
+func (l *pdfLexer) name() pdfName {
+	var b []byte
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if v, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				b = append(b, byte(v))
+				l.pos += 3
+				continue
+			}
+		}
+		b = append(b, c)
+		l.pos++
+	}
+	return pdfName(b)
+}
+
+// literalString reads a string in parentheses (after the opening
+// parenthesis).
+func (l *pdfLexer) literalString() pdfString {
+	var b []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(b)
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return pdfString(b)
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				v := int(c - '0')
+				for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+					v = v*8 + int(l.data[l.pos]-'0')
+					l.pos++
+				}
+				c = byte(v)
+			}
+		}
+		b = append(b, c)
+	}
+	return pdfString(b)
+}
+
+// hexString reads a string in angle brackets (after the opening bracket).
+func (l *pdfLexer) hexString() pdfString {
+	var digits []byte
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '>' {
+			break
+		}
+		if isPDFSpace(c) {
+			continue
+		}
+		digits = append(digits, c)
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b := make([]byte, len(digits)/2)
+	n, _ := hex.Decode(b, digits)
+	return pdfString(b[:n])
+}
+
+// value reads a complete value, including arrays, dictionaries, and indirect
+// references. Keywords (and closing delimiters) are returned as pdfKeyword.
+func (l *pdfLexer) value(depth int) (interface{}, bool) {
+	tok, ok := l.token()
+	if !ok || depth > 100 {
+		return nil, false
+	}
+
+	switch t := tok.(type) {
+	case pdfKeyword:
+		switch t {
+		case "[":
+			arr := pdfArray{}
+			for {
+				v, ok := l.value(depth + 1)
+				if !ok || v == pdfKeyword("]") {
+					return arr, true
+				}
+				arr = append(arr, v)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				k, ok := l.value(depth + 1)
+				if !ok || k == pdfKeyword(">>") {
+					return dict, true
+				}
+				name, isName := k.(pdfName)
+				if !isName {
+					continue
+				}
+				v, ok := l.value(depth + 1)
+				if !ok || v == pdfKeyword(">>") {
+					return dict, true
+				}
+				dict[name] = v
+			}
+		}
+
+	case float64:
+		// Check for an indirect reference ("12 0 R").
+		if t >= 0 && t == math.Trunc(t) {
+			save := l.pos
+			if gen, ok := l.token(); ok {
+				if g, isNum := gen.(float64); isNum && g >= 0 && g == math.Trunc(g) {
+					if r, ok := l.token(); ok && r == pdfKeyword("R") {
+						return pdfRef{int(t), int(g)}, true
+					}
+				}
+			}
+			l.pos = save
+		}
+	}
+
+	return tok, true
+}
+
+// A pdfDocument gives access to the objects in a PDF file.
+type pdfDocument struct {
+	data []byte
+
+	// offsets holds the positions of the objects (after "N G obj").
+	offsets map[int]int
+
+	// compressed holds the objects that were found in object streams.
+	compressed map[int]interface{}
+
+	cache map[int]interface{}
+	fonts map[int]*pdfFont
+
+	// budget is how many more bytes may be decompressed.
+	budget int
+}
+
+var pdfObjectPattern = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+func newPDFDocument(data []byte, budget int) *pdfDocument {
+	d := &pdfDocument{
+		data:       data,
+		offsets:    make(map[int]int),
+		compressed: make(map[int]interface{}),
+		cache:      make(map[int]interface{}),
+		fonts:      make(map[int]*pdfFont),
+		budget:     budget,
+	}
+
+	// If an object appears more than once (because of incremental updates),
+	// the last one is the current version.
+	for _, m := range pdfObjectPattern.FindAllSubmatchIndex(data, -1) {
+		num, err := strconv.Atoi(string(data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+		d.offsets[num] = m[1]
+	}
+
+	for _, num := range d.objectNumbers() {
+		s, ok := d.object(num).(*pdfStream)
+		if ok && s.dict["Type"] == pdfName("ObjStm") {
+			d.loadObjectStream(s)
+		}
+	}
+
+	return d
+}
+
+// encrypted returns whether the document is encrypted: whether its trailer
+// (or a cross-reference stream, which takes the place of the trailer) has an
+// Encrypt entry. (The word /Encrypt may appear elsewhere, such as in the
+// text.)
+func (d *pdfDocument) encrypted() bool {
+	for pos := 0; ; {
+		i := bytes.Index(d.data[pos:], []byte("trailer"))
+		if i == -1 {
+			break
+		}
+		pos += i + len("trailer")
+		l := &pdfLexer{data: d.data, pos: pos}
+		v, _ := l.value(0)
+		if dict, ok := v.(pdfDict); ok && dict["Encrypt"] != nil {
+			return true
+		}
+	}
+
+	for num := range d.offsets {
+		s, ok := d.object(num).(*pdfStream)
+		if ok && s.dict["Type"] == pdfName("XRef") && s.dict["Encrypt"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// objectNumbers returns the numbers of all the objects, in order.
+func (d *pdfDocument) objectNumbers() []int {
+	nums := make([]int, 0, len(d.offsets)+len(d.compressed))
+	for n := range d.offsets {
+		nums = append(nums, n)
+	}
+	for n := range d.compressed {
+		if _, ok := d.offsets[n]; !ok {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// object returns object number num, or nil if it can't be found.
+func (d *pdfDocument) object(num int) interface{} {
+	if v, ok := d.cache[num]; ok {
+		return v
+	}
+	// Guard against reference loops.
+	d.cache[num] = nil
+
+	var v interface{}
+	if off, ok := d.offsets[num]; ok {
+		v = d.parseObject(off)
+	} else {
+		v = d.compressed[num]
+	}
+	d.cache[num] = v
+	return v
+}
+
+// resolve follows indirect references.
+func (d *pdfDocument) resolve(v interface{}) interface{} {
+	for i := 0; i < 10; i++ {
+		r, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = d.object(r.num)
+	}
+	return nil
+}
+
+func (d *pdfDocument) parseObject(off int) interface{} {
+	l := &pdfLexer{data: d.data, pos: off}
+	v, _ := l.value(0)
+	dict, ok := v.(pdfDict)
+	if !ok {
+		return v
+	}
+
+	l.skipSpace()
+	if !bytes.HasPrefix(d.data[l.pos:], []byte("stream")) {
+		return dict
+	}
+	start := l.pos + len("stream")
+	if start < len(d.data) && d.data[start] == '\r' {
+		start++
+	}
+	if start < len(d.data) && d.data[start] == '\n' {
+		start++
+	}
+
+	end := -1
+	if length, ok := d.resolve(dict["Length"]).(float64); ok && length >= 0 {
+		e := start + int(length)
+		if e <= len(d.data) {
+			rest := bytes.TrimLeft(d.data[e:], "\r\n \t")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				end = e
+			}
+		}
+	}
+	if end == -1 {
+		// The Length is missing or wrong, so look for endstream.
+		i := bytes.Index(d.data[start:], []byte("endstream"))
+		if i == -1 {
+			return dict
+		}
+		end = start + i
+	}
+
+	return &pdfStream{dict: dict, data: d.data[start:end]}
+}
+
+// loadObjectStream parses the objects contained in an object stream.
+func (d *pdfDocument) loadObjectStream(s *pdfStream) {
+	data := d.decode(s)
+	n, _ := s.dict["N"].(float64)
+	first, _ := s.dict["First"].(float64)
+	if first < 0 || first > float64(len(data)) {
+		return
+	}
+
+	header := &pdfLexer{data: data[:int(first)]}
+	for i := 0; i < int(n); i++ {
+		numTok, ok1 := header.token()
+		offTok, ok2 := header.token()
+		num, isNum1 := numTok.(float64)
+		off, isNum2 := offTok.(float64)
+		if !ok1 || !ok2 || !isNum1 || !isNum2 {
+			return
+		}
+		if off < 0 || off >= float64(len(data)) {
+			continue
+		}
+		pos := int(first) + int(off)
+		if pos < 0 || pos >= len(data) {
+			continue
+		}
+		if _, ok := d.compressed[int(num)]; ok {
+			continue
+		}
+		l := &pdfLexer{data: data, pos: pos}
+		d.compressed[int(num)], _ = l.value(0)
+	}
+}
+
+// decode returns the decoded data from a stream, or nil if it uses an
+// unsupported filter (such as an image format).
+func (d *pdfDocument) decode(s *pdfStream) []byte {
+	var filters []interface{}
+	switch f := d.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []interface{}{f}
+	case pdfArray:
+		filters = f
+	}
+
+	data := s.data
+	for _, f := range filters {
+		if d.budget <= 0 {
+			return nil
+		}
+		switch d.resolve(f) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil
+			}
+			// Damaged streams are common, so use whatever could be
+			// decompressed.
+			data, _ = io.ReadAll(io.LimitReader(zr, int64(d.budget)))
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			data = bytes.TrimSpace(data)
+			data = bytes.TrimPrefix(data, []byte("<~"))
+			if i := bytes.Index(data, []byte("~>")); i != -1 {
+				data = data[:i]
+			}
+			data, _ = io.ReadAll(io.LimitReader(ascii85.NewDecoder(bytes.NewReader(data)), int64(d.budget)))
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			l := &pdfLexer{data: data}
+			data = []byte(l.hexString())
+		default:
+			return nil
+		}
+		d.budget -= len(data)
+	}
+	return data
+}
+
+// pageResources returns the resource dictionary for a page, which may be
+// inherited from its ancestors in the page tree.
+func (d *pdfDocument) pageResources(page pdfDict) pdfDict {
+	for i := 0; i < 20 && page != nil; i++ {
+		if r, ok := d.resolve(page["Resources"]).(pdfDict); ok {
+			return r
+		}
+		page, _ = d.resolve(page["Parent"]).(pdfDict)
+	}
+	return nil
+}
+
+// contentStreams returns the streams referred to by a page's Contents
+// entry.
+func (d *pdfDocument) contentStreams(contents interface{}) []*pdfStream {
+	switch c := d.resolve(contents).(type) {
+	case *pdfStream:
+		return []*pdfStream{c}
+	case pdfArray:
+		var streams []*pdfStream
+		for _, v := range c {
+			if s, ok := d.resolve(v).(*pdfStream); ok {
+				streams = append(streams, s)
+			}
+		}
+		return streams
+	}
+	return nil
+}
+
+// A pdfFont holds the information needed to convert the strings shown in a
+// font to Unicode text.
+type pdfFont struct {
+	toUnicode *pdfCMap
+
+	// composite is true for Type0 fonts, whose codes can't be decoded without
+	// a ToUnicode map.
+	composite bool
+
+	encoding *[256]string
+}
+
+// font returns the font described by v (a font dictionary, or a reference
+// to one).
+func (d *pdfDocument) font(v interface{}) *pdfFont {
+	ref, isRef := v.(pdfRef)
+	if isRef {
+		if f, ok := d.fonts[ref.num]; ok {
+			return f
+		}
+	}
+
+	f := &pdfFont{encoding: &winAnsiEncoding}
+	if dict, ok := d.resolve(v).(pdfDict); ok {
+		f.composite = dict["Subtype"] == pdfName("Type0")
+		if s, ok := d.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+			f.toUnicode = parseCMap(d.decode(s))
+		}
+
+		switch enc := d.resolve(dict["Encoding"]).(type) {
+		case pdfName:
+			f.encoding = namedPDFEncoding(enc)
+		case pdfDict:
+			f.encoding = namedPDFEncoding(d.resolve(enc["BaseEncoding"]))
+			if diffs, ok := d.resolve(enc["Differences"]).(pdfArray); ok {
+				e := *f.encoding
+				code := 0
+				for _, item := range diffs {
+					switch item := d.resolve(item).(type) {
+					case float64:
+						code = int(item)
+					case pdfName:
+						if code >= 0 && code < 256 {
+							e[code] = glyphText(string(item))
+						}
+						code++
+					}
+				}
+				f.encoding = &e
+			}
+		}
+	}
+
+	if isRef {
+		d.fonts[ref.num] = f
+	}
+	return f
+}
+
+// decodeText converts a string shown in f to Unicode text.
+func (f *pdfFont) decodeText(s string) string {
+	if f == nil {
+		f = &pdfFont{encoding: &winAnsiEncoding}
+	}
+
+	var b strings.Builder
+	if f.toUnicode != nil {
+		for i := 0; i < len(s); {
+			n := f.toUnicode.codeLength(s[i:])
+			code := s[i : i+n]
+			i += n
+			if text, ok := f.toUnicode.chars[code]; ok {
+				b.WriteString(text)
+			} else if !f.composite && n == 1 {
+				b.WriteString(f.encoding[code[0]])
+			}
+		}
+		return b.String()
+	}
+
+	if f.composite {
+		// The codes are glyph IDs, which can't be converted without a
+		// ToUnicode map.
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		b.WriteString(f.encoding[s[i]])
+	}
+	return b.String()
+}
+
+var winAnsiEncoding, macRomanEncoding [256]string
+
+func init() {
+	for i := 0; i < 256; i++ {
+		winAnsiEncoding[i] = string(charmap.Windows1252.DecodeByte(byte(i)))
+		macRomanEncoding[i] = string(charmap.Macintosh.DecodeByte(byte(i)))
+	}
+}
+
+func namedPDFEncoding(name interface{}) *[256]string {
+	if name == pdfName("MacRomanEncoding") {
+		return &macRomanEncoding
+	}
+	// WinAnsiEncoding, and close enough for StandardEncoding and fonts with
+	// a built-in encoding.
+	return &winAnsiEncoding
+}
+
+// glyphNames maps some common glyph names (from the Adobe Glyph List) to
+// text. Single-letter names and uniXXXX names are handled by glyphText.
+var glyphNames = map[string]string{
+	"space": " ", "exclam": "!", "quotedbl": `"`, "numbersign": "#",
+	"dollar": "$", "percent": "%", "ampersand": "&", "quotesingle": "'",
+	"parenleft": "(", "parenright": ")", "asterisk": "*", "plus": "+",
+	"comma": ",", "hyphen": "-", "period": ".", "slash": "/",
+	"zero": "0", "one": "1", "two": "2", "three": "3", "four": "4",
+	"five": "5", "six": "6", "seven": "7", "eight": "8", "nine": "9",
+	"colon": ":", "semicolon": ";", "less": "<", "equal": "=",
+	"greater": ">", "question": "?", "at": "@", "underscore": "_",
+	"quoteleft": "‘", "quoteright": "’", "quotedblleft": "“",
+	"quotedblright": "”", "endash": "–", "emdash": "—",
+	"bullet": "•", "ellipsis": "…", "fi": "fi", "fl": "fl",
+	"ff": "ff", "ffi": "ffi", "ffl": "ffl",
+}
+
+// glyphText returns the text for a glyph name.
+func glyphText(name string) string {
+	if t, ok := glyphNames[name]; ok {
+		return t
+	}
+	if len(name) == 1 {
+		return name
+	}
+	if strings.HasPrefix(name, "uni") && len(name) == 7 {
+		if v, err := strconv.ParseUint(name[3:], 16, 16); err == nil {
+			return string(rune(v))
+		}
+	}
+	// Names like "a.sc" or "e_acute" are variants of a base glyph.
+	if i := strings.IndexAny(name, "._"); i > 0 {
+		return glyphText(name[:i])
+	}
+	return ""
+}
+
+// A pdfCMap is a ToUnicode CMap, mapping character codes to text.
+type pdfCMap struct {
+	codespaces [][2]string
+	chars      map[string]string
+}
+
+// maxCMapEntries limits the memory that a CMap can use.
+const maxCMapEntries = 1 << 17
+
+func parseCMap(data []byte) *pdfCMap {
+	m := &pdfCMap{chars: make(map[string]string)}
+	l := &pdfLexer{data: data}
+	var operands []interface{}
+
+	for {
+		v, ok := l.value(0)
+		if !ok {
+			break
+		}
+		op, isOp := v.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, v)
+			continue
+		}
+
+		switch op {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				lo, ok1 := operands[i].(pdfString)
+				hi, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 && len(lo) == len(hi) && len(lo) > 0 {
+					m.codespaces = append(m.codespaces, [2]string{string(lo), string(hi)})
+				}
+			}
+
+		case "endbfchar":
+			for i := 0; i+1 < len(operands) && len(m.chars) < maxCMapEntries; i += 2 {
+				src, ok := operands[i].(pdfString)
+				if !ok {
+					continue
+				}
+				switch dst := operands[i+1].(type) {
+				case pdfString:
+					m.chars[string(src)] = utf16BEString(string(dst))
+				case pdfName:
+					m.chars[string(src)] = glyphText(string(dst))
+				}
+			}
+
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(pdfString)
+				hi, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+					continue
+				}
+				start, end := codeValue(string(lo)), codeValue(string(hi))
+				if end < start {
+					continue
+				}
+				// The range is limited by the number of codes tried, not
+				// the size of the map, since the destinations might not
+				// add anything to the map. (And c could wrap around if end
+				// is 0xFFFFFFFF.)
+				if uint64(end-start) >= maxCMapEntries {
+					end = start + maxCMapEntries - 1
+				}
+				for c := start; len(m.chars) < maxCMapEntries; c++ {
+					code := codeString(c, len(lo))
+					switch dst := operands[i+2].(type) {
+					case pdfString:
+						m.chars[code] = incrementUTF16BE(string(dst), int(c-start))
+					case pdfArray:
+						if int(c-start) < len(dst) {
+							if s, ok := dst[c-start].(pdfString); ok {
+								m.chars[code] = utf16BEString(string(s))
+							}
+						}
+					}
+					if c == end {
+						break
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+
+	return m
+}
+
+// codeLength returns the length of the character code at the start of s.
+func (m *pdfCMap) codeLength(s string) int {
+	for _, cs := range m.codespaces {
+		n := len(cs[0])
+		if n > len(s) {
+			continue
+		}
+		inRange := true
+		for i := 0; i < n; i++ {
+			if s[i] < cs[0][i] || s[i] > cs[1][i] {
+				inRange = false
+				break
+			}
+		}
+		if inRange {
+			return n
+		}
+	}
+	if len(m.codespaces) > 0 && len(m.codespaces[0][0]) <= len(s) {
+		return len(m.codespaces[0][0])
+	}
+	return 1
+}
+
+func codeValue(s string) uint32 {
+	var v uint32
+	for i := 0; i < len(s); i++ {
+		v = v<<8 | uint32(s[i])
+	}
+	return v
+}
+
+func codeString(v uint32, n int) string {
+	b := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return string(b)
+}
+
+func utf16BEString(s string) string {
+	u := make([]uint16, len(s)/2)
+	for i := range u {
+		u[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+// incrementUTF16BE returns the text for the code that is delta past the
+// start of a bfrange whose first code maps to s.
+func incrementUTF16BE(s string, delta int) string {
+	if len(s) < 2 {
+		return ""
+	}
+	b := []byte(s[:len(s)&^1])
+	last := int(b[len(b)-2])<<8 | int(b[len(b)-1]) + delta
+	b[len(b)-2], b[len(b)-1] = byte(last>>8), byte(last)
+	return utf16BEString(string(b))
+}
+
+// A pdfTextExtractor interprets content streams, and collects the text that
+// they show.
+type pdfTextExtractor struct {
+	doc     *pdfDocument
+	out     bytes.Buffer
+	maxLen  int
+	visited map[int]bool
+}
+
+func (e *pdfTextExtractor) full() bool {
+	return e.out.Len() >= e.maxLen
+}
+
+func (e *pdfTextExtractor) write(s string) {
+	if e.full() {
+		return
+	}
+	if room := e.maxLen - e.out.Len(); len(s) > room {
+		s = s[:room]
+	}
+	e.out.WriteString(s)
+}
+
+// space separates the text from what comes next, unless it is already
+// separated.
+func (e *pdfTextExtractor) space() {
+	if n := e.out.Len(); n > 0 {
+		if last := e.out.Bytes()[n-1]; last != ' ' && last != '\n' {
+			e.write(" ")
+		}
+	}
+}
+
+// extract collects the text from a content stream.
+func (e *pdfTextExtractor) extract(content []byte, resources pdfDict, depth int) {
+	if depth > 10 {
+		return
+	}
+	d := e.doc
+	fonts, _ := d.resolve(resources["Font"]).(pdfDict)
+	xObjects, _ := d.resolve(resources["XObject"]).(pdfDict)
+
+	var font *pdfFont
+	var operands []interface{}
+	l := &pdfLexer{data: content}
+
+	for !e.full() {
+		v, ok := l.value(0)
+		if !ok {
+			break
+		}
+		op, isOp := v.(pdfKeyword)
+		if !isOp {
+			operands = append(operands, v)
+			continue
+		}
+
+		var last interface{}
+		if len(operands) > 0 {
+			last = operands[len(operands)-1]
+		}
+
+		switch op {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[len(operands)-2].(pdfName); ok {
+					font = d.font(fonts[name])
+				}
+			}
+		case "Tj":
+			if s, ok := last.(pdfString); ok {
+				e.write(font.decodeText(string(s)))
+			}
+		case "'", `"`:
+			e.space()
+			if s, ok := last.(pdfString); ok {
+				e.write(font.decodeText(string(s)))
+			}
+		case "TJ":
+			if arr, ok := last.(pdfArray); ok {
+				for _, item := range arr {
+					switch item := item.(type) {
+					case pdfString:
+						e.write(font.decodeText(string(item)))
+					case float64:
+						// A large negative adjustment moves the next glyph
+						// far enough to be a word break.
+						if item < -200 {
+							e.space()
+						}
+					}
+				}
+			}
+		case "Td", "TD", "T*", "Tm", "ET":
+			e.space()
+		case "Do":
+			name, _ := last.(pdfName)
+			if ref, ok := xObjects[name].(pdfRef); ok && !e.visited[ref.num] {
+				e.visited[ref.num] = true
+				if s, ok := d.resolve(ref).(*pdfStream); ok && s.dict["Subtype"] == pdfName("Form") {
+					formResources, ok := d.resolve(s.dict["Resources"]).(pdfDict)
+					if !ok {
+						formResources = resources
+					}
+					e.extract(d.decode(s), formResources, depth+1)
+				}
+			}
+		case "ID":
+			// Skip the data of an inline image.
+			end := bytes.Index(content[l.pos:], []byte("EI"))
+			for end != -1 {
+				p := l.pos + end
+				if p > 0 && isPDFSpace(content[p-1]) && (p+2 == len(content) || isPDFSpace(content[p+2])) {
+					break
+				}
+				next := bytes.Index(content[p+2:], []byte("EI"))
+				if next == -1 {
+					end = -1
+					break
+				}
+				end += 2 + next
+			}
+			if end == -1 {
+				return
+			}
+			l.pos += end + 2
+		}
+		operands = operands[:0]
+	}
+	e.space()
+}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"io"
 	"log"
+	"mime"
 	"strings"
 
 	"golang.org/x/net/html/charset"
@@ -15,35 +16,32 @@ import (
 // scanContent scans the content of a document for phrases,
 // and updates tally.
 func (conf *config) scanContent(content []byte, contentType, cs string, tally map[rule]int) {
-	if strings.Contains(contentType, "javascript") {
-		conf.scanJSContent(content, tally)
-		return
-	}
+	conf.scanContentWithChanges(content, contentType, cs, tally, nil)
+}
 
-	transformers := make([]transform.Transformer, 0, 3)
-	if cs != "utf-8" {
-		e, _ := charset.Lookup(cs)
-		transformers = append(transformers, e.NewDecoder())
+// scanContentWithChanges is like scanContent, but if changed is not nil
+// (and normalize-text is on), it records the words that were changed by
+// normalization.
+func (conf *config) scanContentWithChanges(content []byte, contentType, cs string, tally map[rule]int, changed map[string][]string) {
+	if extract := documentExtractor(content, contentType); extract != nil {
+		content = extract(content, conf.MaxContentScanSize)
+		contentType, cs = "text/plain", "utf-8"
 	}
 
-	if strings.Contains(contentType, "html") {
-		transformers = append(transformers, entityDecoder{})
+	if strings.Contains(contentType, "javascript") {
+		conf.scanJSContent(content, tally, changed)
+		return
 	}
-	transformers = append(transformers, new(wordTransformer))
 
-	ps := newPhraseScanner(conf.ContentPhraseList, func(s string) {
-		tally[rule{t: contentPhrase, content: s}]++
-	})
+	ps := conf.newContentScanner(tally)
 	ps.scanByte(' ')
 
-	var t transform.Transformer
-	if len(transformers) == 1 {
-		t = transformers[0]
-	} else {
-		t = transform.Chain(transformers...)
-	}
+	r := transform.NewReader(bytes.NewReader(content), conf.contentTransformer(contentType, cs, changed))
 
-	r := transform.NewReader(bytes.NewReader(content), t)
+	// The content regexes are matched against the same simplified text as
+	// the phrases.
+	var text []byte
+	hasRegexes := len(conf.ContentRegexes.rules) > 0
 
 	buf := make([]byte, 4096)
 	for {
@@ -51,6 +49,9 @@ func (conf *config) scanContent(content []byte, contentType, cs string, tally ma
 		for _, c := range buf[:n] {
 			ps.scanByte(c)
 		}
+		if hasRegexes {
+			text = append(text, buf[:n]...)
+		}
 		if err != nil {
 			if err != io.EOF {
 				log.Println("Error decoding page content:", err)
@@ -60,22 +61,100 @@ func (conf *config) scanContent(content []byte, contentType, cs string, tally ma
 	}
 
 	ps.scanByte(' ')
+	ps.finish()
+
+	if hasRegexes {
+		conf.ContentRegexes.countMatches(string(text), tally)
+	}
+}
+
+// documentExtractors convert document formats to plain text for phrase
+// scanning. They take the maximum length of text to extract.
+var documentExtractors = map[string]func(content []byte, maxLen int) []byte{
+	"application/pdf": extractPDFText,
+
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   extractOfficeText,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.template":   extractOfficeText,
+	"application/vnd.ms-word.document.macroEnabled.12":                          extractOfficeText,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": extractOfficeText,
+	"application/vnd.openxmlformats-officedocument.presentationml.slideshow":    extractOfficeText,
+	"application/vnd.ms-powerpoint.presentation.macroEnabled.12":                extractOfficeText,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         extractOfficeText,
+	"application/vnd.ms-excel.sheet.macroEnabled.12":                            extractOfficeText,
+	"application/vnd.oasis.opendocument.text":                                   extractOfficeText,
+	"application/vnd.oasis.opendocument.presentation":                           extractOfficeText,
+	"application/vnd.oasis.opendocument.spreadsheet":                            extractOfficeText,
+}
+
+// documentExtractor returns the text extractor for content, if its type
+// (or its signature, if the server sent a generic type) is one of the
+// document formats in documentExtractors.
+func documentExtractor(content []byte, contentType string) func([]byte, int) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/octet-stream", "binary/octet-stream", "application/zip", "application/x-zip-compressed":
+		switch {
+		case bytes.HasPrefix(content, []byte("%PDF-")):
+			return extractPDFText
+		case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+			// It might be an Office document; extractOfficeText will
+			// check.
+			return extractOfficeText
+		}
+	}
+	return documentExtractors[mediaType]
+}
+
+// contentTransformer returns a Transformer that converts content of the
+// given type and charset into the form that is used for phrase scanning.
+// If normalize-text is on, changed is passed on to the textNormalizer.
+func (conf *config) contentTransformer(contentType, cs string, changed map[string][]string) transform.Transformer {
+	transformers := make([]transform.Transformer, 0, 5)
+	if cs != "utf-8" {
+		e, _ := charset.Lookup(cs)
+		transformers = append(transformers, e.NewDecoder())
+	}
+
+	if strings.Contains(contentType, "html") {
+		transformers = append(transformers, entityDecoder{})
+	}
+	transformers = append(transformers, conf.normalizationTransformers(changed)...)
+	transformers = append(transformers, new(wordTransformer))
+
+	if len(transformers) == 1 {
+		return transformers[0]
+	}
+	return transform.Chain(transformers...)
 }
 
 // scanJSContent scans only the contents of quoted JavaScript strings
 // in the document.
-func (conf *config) scanJSContent(content []byte, tally map[rule]int) {
+func (conf *config) scanJSContent(content []byte, tally map[rule]int, changed map[string][]string) {
 	_, items := lex(string(content))
-	ps := newPhraseScanner(conf.ContentPhraseList, func(s string) {
-		tally[rule{t: contentPhrase, content: s}]++
-	})
+	ps := conf.newContentScanner(tally)
+
+	var text strings.Builder
+	hasRegexes := len(conf.ContentRegexes.rules) > 0
 
 	for s := range items {
-		s = wordString(s)
+		if conf.NormalizeText {
+			s, _, _ = transform.String(conf.contentTransformer("text/plain", "utf-8", changed), s)
+		} else {
+			s = wordString(s)
+		}
 		ps.scanByte(' ')
 		for i := 0; i < len(s); i++ {
 			ps.scanByte(s[i])
 		}
 		ps.scanByte(' ')
+		if hasRegexes {
+			text.WriteString(s)
+			text.WriteByte(' ')
+		}
+	}
+	ps.finish()
+
+	if hasRegexes {
+		conf.ContentRegexes.countMatches(text.String(), tally)
 	}
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Detecting clients that pin certificates, and learning not to bump them
+
+// pinningFailureWindow is how long a handshake failure is remembered. If no
+// failures for a site and fingerprint have been seen for this long, the
+// count starts over.
+const pinningFailureWindow = 24 * time.Hour
+
+// A pinningFailures is the record of failed handshakes for one combination
+// of SNI and client fingerprint.
+type pinningFailures struct {
+	Count int
+	Last  time.Time
+
+	// Clients is the set of client IP addresses that have failed.
+	Clients map[string]bool
+}
+
+// A learnedPassthrough is a server name that will not be bumped, because
+// clients have repeatedly rejected Redwood's certificate for it.
+type learnedPassthrough struct {
+	SNI string
+
+	// Fingerprints lists the JA4 (or JA3) fingerprints of the clients that
+	// failed.
+	Fingerprints []string
+
+	// LastError is the most recent handshake error.
+	LastError string
+
+	Added time.Time
+}
+
+// A pinningTracker counts client handshake failures on bumped connections,
+// and keeps the list of server names that have been learned not to bump.
+// It persists across configuration reloads.
+type pinningTracker struct {
+	lock     sync.Mutex
+	filename string
+	dirty    bool
+
+	// failures maps from SNI to fingerprint to failures.
+	failures map[string]map[string]*pinningFailures
+
+	// trustedClients records when each client IP address last completed a
+	// handshake with a bumped connection. Failures are only counted for
+	// clients that trust Redwood's certificate for other sites; otherwise
+	// a device without the CA certificate installed would add every site
+	// it visits to the list.
+	trustedClients map[string]time.Time
+
+	passthrough map[string]*learnedPassthrough
+}
+
+var pinning = &pinningTracker{
+	failures:       make(map[string]map[string]*pinningFailures),
+	trustedClients: make(map[string]time.Time),
+	passthrough:    make(map[string]*learnedPassthrough),
+}
+
+// isPinningFailure returns whether err (from a TLS handshake with a client)
+// is the client rejecting the certificate with an alert. A client that just
+// hangs up isn't counted, since that happens for all sorts of reasons (and
+// is easy to do on purpose).
+func isPinningFailure(err error) bool {
+	msg := err.Error()
+	for _, alert := range []string{"bad certificate", "unknown certificate authority", "unknown certificate", "unsupported certificate", "expired certificate", "revoked certificate", "access denied"} {
+		if strings.Contains(msg, "remote error: tls: "+alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordFailure counts a failed handshake for sni by a client with
+// fingerprint. If the number of failures reaches the pinning-threshold,
+// and they came from at least pinning-clients different client addresses,
+// sni is added to the passthrough list.
+func (pt *pinningTracker) recordFailure(sni, fingerprint, clientIP string, err error) {
+	conf := getConfig()
+	threshold := conf.PinningThreshold
+	if threshold <= 0 || sni == "" {
+		return
+	}
+
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(pt.trustedClients[clientIP]) > pinningFailureWindow {
+		return
+	}
+
+	byFingerprint := pt.failures[sni]
+	if byFingerprint == nil {
+		byFingerprint = make(map[string]*pinningFailures)
+		pt.failures[sni] = byFingerprint
+	}
+	f := byFingerprint[fingerprint]
+	if f == nil {
+		f = new(pinningFailures)
+		byFingerprint[fingerprint] = f
+	}
+
+	if now.Sub(f.Last) > pinningFailureWindow {
+		f.Count = 0
+		f.Clients = nil
+	}
+	f.Count++
+	f.Last = now
+	if f.Clients == nil {
+		f.Clients = make(map[string]bool)
+	}
+	f.Clients[clientIP] = true
+
+	if f.Count < threshold || len(f.Clients) < conf.PinningClients {
+		return
+	}
+
+	lp := pt.passthrough[sni]
+	if lp == nil {
+		lp = &learnedPassthrough{SNI: sni, Added: now}
+		pt.passthrough[sni] = lp
+	}
+	lp.LastError = err.Error()
+	found := false
+	for _, fp := range lp.Fingerprints {
+		if fp == fingerprint {
+			found = true
+		}
+	}
+	if !found {
+		lp.Fingerprints = append(lp.Fingerprints, fingerprint)
+		log.Printf("Clients with fingerprint %s repeatedly rejected the certificate for %s; it will not be bumped for them (last error: %v)", fingerprint, sni, err)
+	}
+	pt.dirty = true
+}
+
+// recordSuccess clears the failure count for sni and fingerprint after a
+// successful handshake.
+func (pt *pinningTracker) recordSuccess(sni, fingerprint, clientIP string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.trustedClients[clientIP] = time.Now()
+
+	if byFingerprint := pt.failures[sni]; byFingerprint != nil {
+		delete(byFingerprint, fingerprint)
+		if len(byFingerprint) == 0 {
+			delete(pt.failures, sni)
+		}
+	}
+}
+
+// learned returns whether sni is on the passthrough list for clients with
+// fingerprint. Other clients (such as browsers, when the site was added
+// because of a pinning app) are still bumped.
+func (pt *pinningTracker) learned(sni, fingerprint string) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	lp := pt.passthrough[sni]
+	if lp == nil {
+		return false
+	}
+	for _, fp := range lp.Fingerprints {
+		if fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// remove takes sni off the passthrough list, and reports whether it was
+// there.
+func (pt *pinningTracker) remove(sni string) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if pt.passthrough[sni] == nil {
+		return false
+	}
+	delete(pt.passthrough, sni)
+	delete(pt.failures, sni)
+	pt.dirty = true
+	return true
+}
+
+// Open sets the file where the passthrough list is saved, and loads the list
+// that was saved there.
+func (pt *pinningTracker) Open(filename string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if filename == pt.filename {
+		return
+	}
+	pt.filename = filename
+	if filename == "" {
+		return
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading pinning file %s: %v", filename, err)
+		}
+		return
+	}
+
+	var saved []*learnedPassthrough
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Error parsing pinning file %s: %v", filename, err)
+		return
+	}
+	for _, lp := range saved {
+		pt.passthrough[lp.SNI] = lp
+	}
+}
+
+// list returns a copy of the passthrough list, sorted by SNI.
+// pt.lock must be held.
+func (pt *pinningTracker) list() []learnedPassthrough {
+	result := make([]learnedPassthrough, 0, len(pt.passthrough))
+	for _, lp := range pt.passthrough {
+		c := *lp
+		c.Fingerprints = append([]string(nil), lp.Fingerprints...)
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SNI < result[j].SNI
+	})
+	return result
+}
+
+// expire discards failure counts and trusted clients that are older than
+// pinningFailureWindow.
+func (pt *pinningTracker) expire() {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	now := time.Now()
+	for sni, byFingerprint := range pt.failures {
+		for fp, f := range byFingerprint {
+			if now.Sub(f.Last) > pinningFailureWindow {
+				delete(byFingerprint, fp)
+			}
+		}
+		if len(byFingerprint) == 0 {
+			delete(pt.failures, sni)
+		}
+	}
+	for ip, t := range pt.trustedClients {
+		if now.Sub(t) > pinningFailureWindow {
+			delete(pt.trustedClients, ip)
+		}
+	}
+}
+
+// save writes the passthrough list to disk, if it has changed since the last
+// save.
+func (pt *pinningTracker) save() {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	if pt.filename == "" || !pt.dirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(pt.list(), "", "\t")
+	if err != nil {
+		log.Println("Error encoding pinning passthrough list:", err)
+		return
+	}
+
+	tmp := pt.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving pinning file %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, pt.filename); err != nil {
+		log.Printf("Error saving pinning file %s: %v", pt.filename, err)
+		return
+	}
+	pt.dirty = false
+}
+
+func init() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			pinning.save()
+			pinning.expire()
+		}
+	}()
+}
+
+// handlePinningList lists the server names that have been learned not to
+// bump. If the "remove" form parameter is present (in a POST request), that
+// name is removed from the list first.
+func handlePinningList(w http.ResponseWriter, r *http.Request) {
+	if sni := r.FormValue("remove"); sni != "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Removing a site from the list requires a POST request.", http.StatusMethodNotAllowed)
+			return
+		}
+		if !pinning.remove(sni) {
+			http.Error(w, sni+" is not in the list.", http.StatusNotFound)
+			return
+		}
+		log.Printf("Removed %s from the pinning passthrough list (requested by %v)", sni, r.RemoteAddr)
+		pinning.save()
+	}
+
+	pinning.lock.Lock()
+	list := pinning.list()
+	pinning.lock.Unlock()
+
+	ServeJSON(w, r, list)
+}
+
+// pinningFingerprint returns the fingerprint to record pinning failures
+// under: the JA4 fingerprint if available, or else the JA3.
+func (s *TLSSession) pinningFingerprint() string {
+	if s.JA4 != "" {
+		return s.JA4
+	}
+	return s.JA3
+}
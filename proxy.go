@@ -42,6 +42,10 @@ type proxyHandler struct {
 	// tlsFingerprint is the JA3 TLS fingerprint of the client (if available).
 	tlsFingerprint string
 
+	// clientHello is the parsed ClientHello message from the client (if
+	// available).
+	clientHello *clientHelloInfo
+
 	// connectPort is the server port that was specified in a CONNECT request.
 	connectPort string
 
@@ -51,6 +55,9 @@ type proxyHandler struct {
 	// rt is the RoundTripper that will be used to fulfill the requests.
 	// If it is nil, a default Transport will be used.
 	rt http.RoundTripper
+
+	// resolved is the set of addresses that rt is connected to (if available).
+	resolved *resolvedServer
 }
 
 var ip6Loopback = net.ParseIP("::1")
@@ -83,6 +90,18 @@ func lanAddress(addr string) bool {
 	return false
 }
 
+// anonymousUser returns the username to use for a client that hasn't
+// authenticated, based on its IP address.
+func anonymousUser(client string) string {
+	if u, ok := getConfig().IPToUser[client]; ok {
+		return u
+	}
+	if lanAddress(client) {
+		return fmt.Sprintf("local/%s", client)
+	}
+	return "Unknown/Anonymous"
+}
+
 var titleSelector = cascadia.MustCompile("title")
 
 func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +110,7 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If a request is directed to Redwood, rather than proxied or intercepted,
 	// it should be handled as an API request.
-	if !h.TLS && r.URL.Host == "" && strings.Contains(r.Host, ":") {
+	if !h.TLS && h.connectPort == "" && r.URL.Host == "" && strings.Contains(r.Host, ":") {
 		handleAPI(w, r)
 		return
 	}
@@ -122,12 +141,8 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			log.Printf("Invalid Proxy-Authorization header from %v: %q", r.RemoteAddr, r.Header.Get("Proxy-Authorization"))
 		}
-	} else if u, ok := getConfig().IPToUser[client]; ok {
-		authUser = u
-	} else if lanAddress(client) {
-		authUser = fmt.Sprintf("local/%s", client)
 	} else {
-		authUser = "Unknown/Anonymous"
+		authUser = anonymousUser(client)
 	}
 
 	// Reconstruct the URL if it is incomplete (i.e. on a transparent proxy).
@@ -205,6 +220,12 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.tlsFingerprint != "" {
 		r = r.WithContext(context.WithValue(r.Context(), tlsFingerprintKey{}, h.tlsFingerprint))
 	}
+	if h.clientHello != nil {
+		r = r.WithContext(context.WithValue(r.Context(), clientHelloKey{}, h.clientHello))
+	}
+	if h.resolved != nil {
+		r = r.WithContext(context.WithValue(r.Context(), resolvedServerKey{}, h.resolved))
+	}
 
 	request := &Request{
 		Request:  r,
@@ -213,6 +234,7 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filterRequest(request, !h.TLS)
+	r = request.Request
 
 	if request.Action.Action == "require-auth" {
 		send407(w)
@@ -241,6 +263,10 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		showBlockPage(w, r, nil, user, request.Tally, request.Scores.data, request.Action)
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
 		return
+	case "block-upload":
+		showBlockPage(w, r, nil, user, request.UploadTally, request.UploadScores, request.Action)
+		logAccess(r, nil, 0, false, user, request.UploadTally, request.UploadScores, request.Action, "", request.Ignored)
+		return
 	case "block-invisible":
 		showInvisibleBlock(w)
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
@@ -266,7 +292,7 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Print(fmt.Errorf("error printing to connection: %s", err))
 		}
 		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
-		connectDirect(conn, r.URL.Host, nil, dialer)
+		connectDirect(r.Context(), conn, r.URL.Host, nil, dialer)
 		return
 	}
 
@@ -320,6 +346,43 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	getConfig().changeQuery(r.URL)
 
+	icapResp, icapRule, icapModified, err := icapReqmod(request)
+	if err != nil {
+		showErrorPage(w, r, err)
+		log.Printf("ICAP error for %s: %v", r.URL, err)
+		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+		return
+	}
+	if icapResp != nil {
+		defer func(Body io.ReadCloser) {
+			Lce(Body.Close())
+		}(icapResp.Body)
+		n := serveICAPResponse(w, r, icapResp)
+		logAccess(r, icapResp, n, false, user, request.Tally, request.Scores.data, icapRule, "", request.Ignored)
+		return
+	}
+	if icapModified {
+		// The ICAP server may have changed the URL, headers, or body, so
+		// the request needs to be filtered again, in case the new version
+		// should be blocked.
+		refilterRequest(request)
+		r = request.Request
+		switch request.Action.Action {
+		case "block":
+			showBlockPage(w, r, nil, user, request.Tally, request.Scores.data, request.Action)
+			logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+			return
+		case "block-upload":
+			showBlockPage(w, r, nil, user, request.UploadTally, request.UploadScores, request.Action)
+			logAccess(r, nil, 0, false, user, request.UploadTally, request.UploadScores, request.Action, "", request.Ignored)
+			return
+		case "block-invisible":
+			showInvisibleBlock(w)
+			logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+			return
+		}
+	}
+
 	var rt http.RoundTripper
 	switch {
 	case r.URL.Scheme == "ftp":
@@ -329,6 +392,11 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		rt = httpTransport
 	}
+	if r.URL.Scheme != "ftp" && responseCache.enabled() {
+		conf := getConfig()
+		bypassRule, _ := conf.ChooseACLCategoryAction(request.ACLs.data, request.Scores.data, conf.Threshold, "bypass-cache")
+		rt = responseCache.transport(rt, bypassRule.Action == "bypass-cache")
+	}
 
 	// Some HTTP/2 servers don't like having a body on a GET request, even if
 	// it is empty.
@@ -401,6 +469,27 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		scanAction, _ = conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, possibleActions...)
 	}
 
+	if icapRule, modified, err := icapRespmod(response); err != nil {
+		showErrorPage(w, r, err)
+		log.Printf("ICAP error for %s: %v", r.URL, err)
+		logAccess(r, resp, 0, false, user, response.Tally, response.Scores.data, response.Action, "", response.Ignored)
+		return
+	} else if modified {
+		originalStatus := resp.StatusCode
+		resp = response.Response
+		defer func(Body io.ReadCloser) {
+			Lce(Body.Close())
+		}(resp.Body)
+		if resp.StatusCode != originalStatus {
+			// The ICAP server replaced the response with its own (usually a
+			// block page), so it is sent to the client without further
+			// filtering.
+			n := serveICAPResponse(w, r, resp)
+			logAccess(r, resp, n, true, user, response.Tally, response.Scores.data, icapRule, "", response.Ignored)
+			return
+		}
+	}
+
 	switch scanAction.Action {
 	case "phrase-scan":
 		if err := doPhraseScan(response); err != nil {
@@ -425,6 +514,8 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	hashBeforeFiltering(response)
+
 	response.PossibleActions = []string{"allow", "block", "block-invisible"}
 
 	filterResponse(response)
@@ -442,6 +533,28 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	startHashing(response)
+
+	if sb, ok := response.Response.Body.(scanningBody); ok {
+		n, blockRule, err := sb.copyTo(w)
+		if err != nil && err != context.Canceled {
+			log.Printf("error while copying response (URL: %s): %s", r.URL, err)
+		}
+		switch {
+		case blockRule.Action == "":
+		case n == 0 && blockRule.Action == "block":
+			showBlockPage(w, r, resp, user, response.Tally, response.Scores.data, blockRule)
+		case n == 0:
+			showInvisibleBlock(w)
+		default:
+			// Part of the page has already been sent, so abort the response.
+			logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, blockRule, response.PageTitle, response.Ignored)
+			panic(http.ErrAbortHandler)
+		}
+		logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored)
+		return
+	}
+
 	if response.Response.ContentLength > 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(response.Response.ContentLength, 10))
 	}
@@ -454,10 +567,28 @@ func (h proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logAccess(r, resp, n, response.Modified, user, response.Tally, response.Scores.data, response.Action, response.PageTitle, response.Ignored)
 }
 
+// refilterRequest filters req again after it has been changed (by an ICAP
+// REQMOD service), discarding the action that was chosen the first time.
+func refilterRequest(req *Request) {
+	req.Action = ACLActionRule{}
+	req.Ignored = nil
+	req.UploadTally = nil
+	req.UploadScores = nil
+	filterRequest(req, false)
+}
+
 func filterRequest(req *Request, checkAuth bool) {
-	r := req.Request
+	r := getConfig().ACLs.withResolvedServer(req.Request, hostOnly(req.Request.URL.Host))
+	req.Request = r
 
 	req.Tally = getConfig().URLRules.MatchingRules(r.URL)
+	var uploadTally map[rule]int
+	if conf := getConfig(); conf.ACLs.scansUploads() {
+		uploadTally = make(map[rule]int)
+		if !conf.scanUpload(r, uploadTally) {
+			uploadTally = nil
+		}
+	}
 	req.Scores.data = getConfig().categoryScores(req.Tally)
 
 	for _, classifier := range getConfig().ExternalClassifiers {
@@ -490,6 +621,11 @@ func filterRequest(req *Request, checkAuth bool) {
 	}
 
 	req.ACLs.data = getConfig().ACLs.requestACLs(r, req.User)
+	quotaUser := req.User
+	if quotaUser == "" {
+		quotaUser = req.ClientIP
+	}
+	getConfig().applyQuotas(req.ACLs.data, req.Scores.data, quotaUser)
 	req.PossibleActions = []string{
 		"allow",
 		"block",
@@ -501,6 +637,12 @@ func filterRequest(req *Request, checkAuth bool) {
 	FilterRequest(req)
 
 	req.chooseAction()
+	if uploadTally != nil && req.Action.Action == "allow" {
+		req.checkUpload(uploadTally)
+	}
+
+	parent := getConfig().chooseParentProxy(req.ACLs.data)
+	req.Request = req.Request.WithContext(withParentProxy(req.Request.Context(), parent))
 }
 
 func doPhraseScan(response *Response) error {
@@ -508,6 +650,11 @@ func doPhraseScan(response *Response) error {
 	if err != nil {
 		return err
 	}
+	if content == nil && canStreamScan(response) {
+		// The page is too big to buffer, so scan it as it is sent to the
+		// client.
+		return startStreamScan(response)
+	}
 	if content != nil {
 		conf := getConfig()
 		contentType := response.Response.Header.Get("Content-Type")
@@ -642,7 +789,7 @@ func (resp *Response) Thumbnail(maxSize int) []byte {
 func copyResponseHeader(w http.ResponseWriter, resp *http.Response) {
 	newHeader := w.Header()
 	for key, values := range resp.Header {
-		if key == "Content-Length" {
+		if key == "Content-Length" || key == cacheStatusHeader {
 			continue
 		}
 		for _, v := range values {
@@ -708,9 +855,9 @@ func (h proxyHandler) makeWebsocketConnection(w http.ResponseWriter, r *http.Req
 	if ct, ok := h.rt.(*connTransport); ok {
 		serverConn = ct.Conn
 	} else if h.TLS {
-		serverConn, err = dialWithExtraRootCerts("tcp", addr)
+		serverConn, err = dialWithExtraRootCertsContext(r.Context(), "tcp", addr)
 	} else {
-		serverConn, err = net.Dial("tcp", addr)
+		serverConn, err = dialPinned(r.Context(), dialer, "tcp", addr)
 	}
 	if err != nil {
 		log.Printf("Error making websocket connection to %s: %v", addr, err)
@@ -836,6 +983,11 @@ type Request struct {
 
 	scoresAndACLs
 
+	// UploadTally and UploadScores are the results of scanning the
+	// request body, if it was blocked with block-upload.
+	UploadTally  map[rule]int
+	UploadScores map[string]int
+
 	frozen bool
 }
 
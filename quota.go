@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daily time-budget quotas
+
+// A QuotaRule limits how many minutes per day a user may spend on requests
+// that belong to a certain set of ACLs (including categories).
+type QuotaRule struct {
+	// Name identifies the quota in the quota file and the API.
+	Name string
+
+	// Budget is how much time a user is allowed each day.
+	Budget time.Duration
+
+	// Needed is a list of ACLs that the request must belong to.
+	Needed []string
+
+	// Disallowed is a list of ACLs that the request must not belong to.
+	Disallowed []string
+}
+
+// parseQuotaRule parses the arguments of a quota line in an ACL file:
+// a name, a time budget, and a list of ACL conditions.
+func parseQuotaRule(args []string) (QuotaRule, error) {
+	if len(args) < 3 {
+		return QuotaRule{}, fmt.Errorf("a quota needs a name, a time budget, and at least one ACL")
+	}
+
+	q := QuotaRule{Name: args[0]}
+
+	if minutes, err := strconv.Atoi(args[1]); err == nil {
+		q.Budget = time.Duration(minutes) * time.Minute
+	} else {
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return QuotaRule{}, fmt.Errorf("invalid time budget for quota %s: %q", q.Name, args[1])
+		}
+		q.Budget = d
+	}
+
+	for _, a := range args[2:] {
+		if strings.HasPrefix(a, "!") {
+			q.Disallowed = append(q.Disallowed, a[1:])
+		} else {
+			q.Needed = append(q.Needed, a)
+		}
+	}
+	if len(q.Needed) == 0 {
+		return QuotaRule{}, fmt.Errorf("quota %s has no required ACLs", q.Name)
+	}
+
+	return q, nil
+}
+
+// matches returns whether a request with acls is subject to q.
+func (q QuotaRule) matches(acls map[string]bool) bool {
+	for _, a := range q.Needed {
+		if !acls[a] {
+			return false
+		}
+	}
+	for _, a := range q.Disallowed {
+		if acls[a] {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaACLs returns a copy of acls with the request's categories added.
+// Categories with the ACL action are added if their score is positive; other
+// categories (and their parents) are added if they are over the threshold.
+func (conf *config) quotaACLs(acls map[string]bool, scores map[string]int) map[string]bool {
+	result := copyACLSet(acls)
+	for cat, score := range scores {
+		c := conf.Categories[cat]
+		if c == nil || score <= 0 || c.action != ACL && score < conf.Threshold {
+			continue
+		}
+		result[cat] = true
+		for strings.Contains(cat, "/") {
+			cat = cat[:strings.LastIndex(cat, "/")]
+			result[cat] = true
+		}
+	}
+	return result
+}
+
+// applyQuotas records the current minute against each quota that applies to
+// the request, and adds the quota-exceeded ACL to acls if any of those quotas
+// have been used up.
+func (conf *config) applyQuotas(acls map[string]bool, scores map[string]int, user string) {
+	if len(conf.ACLs.Quotas) == 0 || user == "" {
+		return
+	}
+
+	withCategories := conf.quotaACLs(acls, scores)
+	now := time.Now()
+	for _, q := range conf.ACLs.Quotas {
+		if !q.matches(withCategories) {
+			continue
+		}
+		if quotas.record(user, q, now) {
+			acls["quota-exceeded"] = true
+		}
+	}
+}
+
+// A quotaUsage is one user's usage of one quota during the current period.
+type quotaUsage struct {
+	// Minutes is the number of distinct minutes in which the user made
+	// requests that were subject to the quota.
+	Minutes int
+
+	// LastMinute is the most recent minute (in Unix time) that was counted.
+	LastMinute int64
+}
+
+// A quotaTracker keeps track of how much of each quota each user has used.
+// It persists across configuration reloads.
+type quotaTracker struct {
+	lock     sync.Mutex
+	filename string
+	dirty    bool
+
+	// period identifies the day that the counters apply to.
+	period string
+
+	// usage maps from user to quota name to usage.
+	usage map[string]map[string]*quotaUsage
+}
+
+var quotas = new(quotaTracker)
+
+// quotaPeriod returns the identifier of the quota period containing t.
+// Periods start at the time of day set by quota-reset.
+func quotaPeriod(t time.Time) string {
+	resetAt := 0
+	if conf := getConfig(); conf != nil {
+		resetAt = conf.QuotaReset
+	}
+	return t.Add(-time.Duration(resetAt) * time.Minute).Format("2006-01-02")
+}
+
+// checkPeriod clears the counters if a new quota period has started.
+// qt.lock must be held.
+func (qt *quotaTracker) checkPeriod(now time.Time) {
+	p := quotaPeriod(now)
+	if p != qt.period {
+		qt.period = p
+		qt.usage = make(map[string]map[string]*quotaUsage)
+		qt.dirty = true
+	}
+}
+
+// record counts the minute containing now against user's usage of q, and
+// returns whether the quota has been used up.
+func (qt *quotaTracker) record(user string, q QuotaRule, now time.Time) (exceeded bool) {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	qt.checkPeriod(now)
+
+	byQuota := qt.usage[user]
+	if byQuota == nil {
+		byQuota = make(map[string]*quotaUsage)
+		qt.usage[user] = byQuota
+	}
+	u := byQuota[q.Name]
+	if u == nil {
+		u = new(quotaUsage)
+		byQuota[q.Name] = u
+	}
+
+	if time.Duration(u.Minutes)*time.Minute >= q.Budget {
+		return true
+	}
+
+	minute := now.Unix() / 60
+	if minute != u.LastMinute {
+		u.Minutes++
+		u.LastMinute = minute
+		qt.dirty = true
+	}
+	return false
+}
+
+// quotaFile is the format of the file where quota usage is saved.
+type quotaFile struct {
+	Period string
+	Usage  map[string]map[string]*quotaUsage
+}
+
+// Open sets the file where quota usage is saved, and loads the usage that
+// was saved there, if it is for the current period.
+func (qt *quotaTracker) Open(filename string) {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	if filename == qt.filename {
+		return
+	}
+	qt.filename = filename
+	if filename == "" {
+		return
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading quota file %s: %v", filename, err)
+		}
+		return
+	}
+
+	var saved quotaFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Error parsing quota file %s: %v", filename, err)
+		return
+	}
+
+	qt.checkPeriod(time.Now())
+	if saved.Period == qt.period && saved.Usage != nil {
+		qt.usage = saved.Usage
+	}
+}
+
+// save writes the quota usage to disk, if it has changed since the last save.
+func (qt *quotaTracker) save() {
+	qt.lock.Lock()
+	defer qt.lock.Unlock()
+
+	if qt.filename == "" || !qt.dirty {
+		return
+	}
+
+	data, err := json.Marshal(quotaFile{
+		Period: qt.period,
+		Usage:  qt.usage,
+	})
+	if err != nil {
+		log.Println("Error encoding quota usage:", err)
+		return
+	}
+
+	tmp := qt.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving quota file %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, qt.filename); err != nil {
+		log.Printf("Error saving quota file %s: %v", qt.filename, err)
+		return
+	}
+	qt.dirty = false
+}
+
+func init() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			quotas.save()
+		}
+	}()
+}
+
+type quotaStatus struct {
+	User      string
+	Quota     string
+	Minutes   int
+	Budget    int
+	Exceeded  bool
+	LastUsed  time.Time
+	ResetTime time.Time
+}
+
+// handleQuotaStatus reports the quota usage for the user specified by the
+// "user" form parameter, or for all users if it is absent.
+func handleQuotaStatus(w http.ResponseWriter, r *http.Request) {
+	conf := getConfig()
+	user := r.FormValue("user")
+
+	budgets := make(map[string]time.Duration)
+	for _, q := range conf.ACLs.Quotas {
+		budgets[q.Name] = q.Budget
+	}
+
+	now := time.Now()
+	resetTime := time.Date(now.Year(), now.Month(), now.Day(), 0, conf.QuotaReset, 0, 0, now.Location())
+	if !resetTime.After(now) {
+		resetTime = resetTime.AddDate(0, 0, 1)
+	}
+
+	var result []quotaStatus
+	quotas.lock.Lock()
+	quotas.checkPeriod(now)
+	for u, byQuota := range quotas.usage {
+		if user != "" && u != user {
+			continue
+		}
+		for name, usage := range byQuota {
+			budget, ok := budgets[name]
+			if !ok {
+				continue
+			}
+			s := quotaStatus{
+				User:      u,
+				Quota:     name,
+				Minutes:   usage.Minutes,
+				Budget:    int(budget / time.Minute),
+				Exceeded:  time.Duration(usage.Minutes)*time.Minute >= budget,
+				ResetTime: resetTime,
+			}
+			if usage.LastMinute != 0 {
+				s.LastUsed = time.Unix(usage.LastMinute*60, 0)
+			}
+			result = append(result, s)
+		}
+	}
+	quotas.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].User != result[j].User {
+			return result[i].User < result[j].User
+		}
+		return result[i].Quota < result[j].Quota
+	})
+
+	ServeJSON(w, r, result)
+}
@@ -34,10 +34,23 @@ func main() {
 		return
 	}
 
+	if conf.SquidHelper != "" {
+		// Standard output is for the replies to Squid.
+		defaultLogOutput = os.Stderr
+	}
+
 	accessLog.Open(conf.AccessLog)
 	tlsLog.Open(conf.TLSLog)
 	contentLog.Open(conf.ContentLog)
 	starlarkLog.Open(conf.StarlarkLog)
+	quotas.Open(conf.QuotaFile)
+	pinning.Open(conf.PinningFile)
+	responseCache.Open(conf.CacheDir, int64(conf.CacheSize)<<20, int64(conf.MaxCacheObjectSize))
+
+	if conf.SquidHelper != "" {
+		runSquidHelper(os.Stdin, os.Stdout)
+		return
+	}
 
 	if conf.PIDFile != "" {
 		pid := os.Getpid()
@@ -50,9 +63,7 @@ func main() {
 		}
 	}
 
-	if conf.CloseIdleConnections > 0 {
-		httpTransport.IdleConnTimeout = conf.CloseIdleConnections
-	}
+	configureUpstreamTransport(conf)
 
 	portsListening := 0
 
@@ -93,6 +104,36 @@ func main() {
 		portsListening++
 	}
 
+	for _, addr := range conf.SOCKSAddresses {
+		go func(addr string) {
+			err := runSOCKSServer(addr)
+			if err != nil && !strings.Contains(err.Error(), "use of closed") {
+				log.Fatalln("Error running SOCKS proxy:", err)
+			}
+		}(addr)
+		portsListening++
+	}
+
+	for _, addr := range conf.ICAPAddresses {
+		go func(addr string) {
+			err := runICAPServer(addr)
+			if err != nil && !strings.Contains(err.Error(), "use of closed") {
+				log.Fatalln("Error running ICAP server:", err)
+			}
+		}(addr)
+		portsListening++
+	}
+
+	for _, addr := range conf.DNSProxyAddresses {
+		go func(addr string) {
+			err := runDNSProxy(addr)
+			if err != nil && !strings.Contains(err.Error(), "use of closed") {
+				log.Fatalln("Error running DNS proxy:", err)
+			}
+		}(addr)
+		portsListening++
+	}
+
 	conf.openPerUserPorts()
 	portsListening += len(conf.CustomPorts)
 	log.Print("Loaded Categories: ")
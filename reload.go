@@ -54,6 +54,10 @@ func reloadConfig() error {
 	tlsLog.Open(newConf.TLSLog)
 	contentLog.Open(filepath.Join(newConf.ContentLogDir, "index.csv"))
 	starlarkLog.Open(newConf.StarlarkLog)
+	quotas.Open(newConf.QuotaFile)
+	pinning.Open(newConf.PinningFile)
+	responseCache.Open(newConf.CacheDir, int64(newConf.CacheSize)<<20, int64(newConf.MaxCacheObjectSize))
+	configureUpstreamTransport(newConf)
 	newConf.openPerUserPorts()
 
 	log.Println("Reloaded configuration")
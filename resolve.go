@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Resolving server addresses for ACLs, and making sure that upstream
+// connections go to the same addresses that the ACLs were evaluated with.
+
+// A resolvedServer is the set of IP addresses that a server's hostname
+// resolved to.
+type resolvedServer struct {
+	Host string
+	IPs  []net.IP
+
+	// Fixed is whether requests will be sent to these addresses no matter
+	// what host is in their URLs (because they are going over a connection
+	// to Host, as in an intercepted TLS connection).
+	Fixed bool
+}
+
+// appliesTo returns whether rs holds the addresses that a request for host
+// will be sent to.
+func (rs *resolvedServer) appliesTo(host string) bool {
+	return rs.Fixed || rs.Host == host
+}
+
+type resolvedServerKey struct{}
+
+// resolvedServerFromContext returns the resolvedServer stored in ctx, if any.
+func resolvedServerFromContext(ctx context.Context) *resolvedServer {
+	rs, _ := ctx.Value(resolvedServerKey{}).(*resolvedServer)
+	return rs
+}
+
+// hostOnly returns the host part of hostport, which may or may not include
+// a port number.
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// resolveServer looks up the IP addresses for host. If host is an IP address
+// literal, no lookup is done.
+func resolveServer(ctx context.Context, host string) *resolvedServer {
+	rs := &resolvedServer{Host: host}
+	if ip := net.ParseIP(host); ip != nil {
+		rs.IPs = []net.IP{ip}
+		return rs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		logVerbose("resolve", "Error resolving %s: %v", host, err)
+		return rs
+	}
+	for _, a := range addrs {
+		rs.IPs = append(rs.IPs, a.IP)
+	}
+	return rs
+}
+
+// needsServerAddresses returns whether any ACLs depend on the server's IP
+// addresses, so that the server's hostname needs to be resolved before
+// the ACLs are evaluated.
+func (a *ACLDefinitions) needsServerAddresses() bool {
+	return !a.ServerIPs.empty()
+}
+
+// withResolvedServer returns r with the addresses of host stored in its
+// context (if they are needed by the ACLs). If r's context already has
+// addresses for host (or for a connection that is already open), they are
+// left unchanged; addresses for a different host (because the request has
+// been rewritten) are replaced.
+func (a *ACLDefinitions) withResolvedServer(r *http.Request, host string) *http.Request {
+	if !a.needsServerAddresses() {
+		return r
+	}
+	if rs := resolvedServerFromContext(r.Context()); rs != nil && rs.appliesTo(host) {
+		return r
+	}
+	rs := resolveServer(r.Context(), host)
+	return r.WithContext(context.WithValue(r.Context(), resolvedServerKey{}, rs))
+}
+
+// withResolvedDestination is like withResolvedServer, but for a request
+// that stands for a connection to host, whatever its URL says (such as the
+// virtual CONNECT request for an intercepted TLS connection). The addresses
+// are always looked up again.
+func (a *ACLDefinitions) withResolvedDestination(r *http.Request, host string) *http.Request {
+	if !a.needsServerAddresses() {
+		return r
+	}
+	rs := resolveServer(r.Context(), host)
+	rs.Fixed = true
+	return r.WithContext(context.WithValue(r.Context(), resolvedServerKey{}, rs))
+}
+
+var errNoAddresses = errors.New("no addresses found")
+
+// dialPinned connects to addr. If a parent proxy has been selected for ctx,
+// the connection goes through the parent proxy. If ctx contains a
+// resolvedServer for addr's host, it connects (or asks the parent proxy to
+// connect) to one of those addresses instead of looking up the hostname
+// again.
+func dialPinned(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if parent := parentProxyFromContext(ctx); parent != nil {
+		return dialThroughParent(ctx, d, parent, network, addr)
+	}
+	return dialDirectPinned(ctx, d, network, addr)
+}
+
+// dialDirectPinned is like dialPinned, but it never uses a parent proxy.
+func dialDirectPinned(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	addrs, err := pinnedAddrs(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialEach(ctx, addrs, func(a string) (net.Conn, error) {
+		return d.DialContext(ctx, network, a)
+	})
+}
+
+// pinnedAddrs returns the addresses to connect to for addr: if ctx contains
+// a resolvedServer for addr's host, its IP addresses (with addr's port);
+// otherwise just addr.
+func pinnedAddrs(ctx context.Context, network, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}, nil
+	}
+	rs := resolvedServerFromContext(ctx)
+	if rs == nil || rs.Host != host {
+		return []string{addr}, nil
+	}
+	if len(rs.IPs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: errNoAddresses.Error(), Name: host}}
+	}
+	addrs := make([]string, len(rs.IPs))
+	for i, ip := range rs.IPs {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs, nil
+}
+
+// dialEach calls dial with each of addrs in turn, until one succeeds.
+func dialEach(ctx context.Context, addrs []string, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := dial(a)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialTLSPinned is like dialPinned, but it also performs a TLS handshake
+// with config.
+func dialTLSPinned(ctx context.Context, d *net.Dialer, network, addr string, config *tls.Config) (*tls.Conn, error) {
+	conn, _, err := dialTLSPinnedRecording(ctx, d, network, addr, config, false)
+	return conn, err
+}
+
+// dialTLSPinnedRecording is like dialTLSPinned, but if recordHello is true,
+// it also returns the JA4S fingerprint of the server's ServerHello message.
+func dialTLSPinnedRecording(ctx context.Context, d *net.Dialer, network, addr string, config *tls.Config, recordHello bool) (conn *tls.Conn, ja4sFingerprint string, err error) {
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	rawConn, err := dialPinned(ctx, d, network, addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if config.ServerName == "" {
+		// Like tls.Dial, use the hostname from addr for verification.
+		config = config.Clone()
+		config.ServerName = hostOnly(addr)
+	}
+
+	var recorder *serverHelloRecorder
+	if recordHello {
+		recorder = &serverHelloRecorder{Conn: rawConn}
+		conn = tls.Client(recorder, config)
+	} else {
+		conn = tls.Client(rawConn, config)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, "", err
+	}
+
+	if recorder != nil {
+		hello, err := recorder.ServerHello()
+		if err == nil {
+			ja4sFingerprint, err = ja4s(hello)
+		}
+		if err != nil {
+			logVerbose("ja4", "Error calculating JA4S fingerprint for %s: %v", addr, err)
+		}
+	}
+	return conn, ja4sFingerprint, nil
+}
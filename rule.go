@@ -6,7 +6,7 @@ import (
 	"strings"
 )
 
-// A rule is a URL fragment, URL regular expression, or content phrase
+// A rule is a URL fragment, URL regular expression, content phrase, or hash
 // that will be matched against a page in the process of determining its score.
 type rule struct {
 	t       ruleType
@@ -24,7 +24,12 @@ const (
 	pathRegex
 	queryRegex
 	contentPhrase
+	contentSubstring
+	contentRegex
+	combinationRule
 	imageHash
+	fileHash
+	dataPatternMatch
 )
 
 func (r rule) String() string {
@@ -46,8 +51,18 @@ func (r rule) String() string {
 		return "/" + r.content + "/" + suffix
 	case contentPhrase:
 		return "<" + r.content + ">"
+	case contentSubstring:
+		return "<" + r.content + ">s"
+	case contentRegex:
+		return "</" + r.content + "/>"
+	case combinationRule:
+		return r.content
 	case imageHash:
 		return "%" + r.content
+	case fileHash:
+		return fileHashPrefix + r.content
+	case dataPatternMatch:
+		return dataPatternPrefix + r.content
 	}
 	panic(fmt.Errorf("invalid rule type: %d", r.t))
 }
@@ -60,6 +75,24 @@ func parseRule(s string) (r rule, leftover string, err error) {
 		return rule{}, "", errors.New("blank rule")
 	}
 
+	for _, p := range []struct {
+		prefix string
+		t      ruleType
+	}{
+		{fileHashPrefix, fileHash},
+		{dataPatternPrefix, dataPatternMatch},
+	} {
+		if strings.HasPrefix(s, p.prefix) {
+			r.t = p.t
+			r.content, s = s[len(p.prefix):], ""
+			if space := strings.Index(r.content, " "); space != -1 {
+				r.content, s = r.content[:space], r.content[space:]
+			}
+			r.content = strings.ToLower(r.content)
+			return r, s, nil
+		}
+	}
+
 	switch s[0] {
 	case '/':
 		r.t = urlRegex
@@ -92,6 +125,19 @@ func parseRule(s string) (r rule, leftover string, err error) {
 			}
 		}
 	case '<':
+		if strings.HasPrefix(s, "</") {
+			r.t = contentRegex
+			end := strings.LastIndex(s, "/>")
+			if end < 2 {
+				return rule{}, s, errors.New("unmatched '</'")
+			}
+			r.content = s[2:end]
+			s = s[end+2:]
+			break
+		}
+		if strings.Contains(s, ">,<") {
+			return parseCombination(s)
+		}
 		r.t = contentPhrase
 		bracket := strings.LastIndex(s, ">")
 		if bracket == -1 {
@@ -99,6 +145,10 @@ func parseRule(s string) (r rule, leftover string, err error) {
 		}
 		r.content = wordString(s[1:bracket])
 		s = s[bracket+1:]
+		if s != "" && s[0] == 's' {
+			r.t = contentSubstring
+			s = s[1:]
+		}
 	case '%':
 		r.t = imageHash
 		space := strings.Index(s, " ")
@@ -0,0 +1,279 @@
+package main
+
+// Word segmentation for languages that are written without spaces between
+// words (Chinese, Japanese, and Thai), so that phrases in those languages
+// match whole words instead of any sequence of characters.
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// segmentDictionaries are the word lists that are used for segmentation,
+// one word per line.
+//
+//go:embed segment/*.txt
+var segmentDictionaries embed.FS
+
+// maxSegmentRun is the most bytes of unspaced text that a contentScanner
+// will collect before segmenting it.
+const maxSegmentRun = 1024
+
+// A segmentDictionary is a set of words that are used for segmentation.
+type segmentDictionary struct {
+	words  map[string]bool
+	maxLen int // the length (in runes) of the longest word
+}
+
+func newSegmentDictionary() *segmentDictionary {
+	return &segmentDictionary{words: make(map[string]bool)}
+}
+
+func (d *segmentDictionary) add(w string) {
+	d.words[w] = true
+	if n := utf8.RuneCountInString(w); n > d.maxLen {
+		d.maxLen = n
+	}
+}
+
+var (
+	builtinSegmentWords *segmentDictionary
+	loadSegmentWords    sync.Once
+)
+
+// builtinSegmentDictionary returns the words from the built-in word lists,
+// loading them the first time it is called.
+func builtinSegmentDictionary() *segmentDictionary {
+	loadSegmentWords.Do(func() {
+		builtinSegmentWords = newSegmentDictionary()
+		names, _ := fs.Glob(segmentDictionaries, "segment/*.txt")
+		for _, name := range names {
+			data, err := segmentDictionaries.ReadFile(name)
+			if err != nil {
+				log.Println("Error loading segmentation dictionary:", err)
+				continue
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || line[0] == '#' {
+					continue
+				}
+				builtinSegmentWords.add(wordString(line))
+			}
+		}
+	})
+	return builtinSegmentWords
+}
+
+// segmentDictionary returns the dictionary to segment text with: the
+// built-in words plus the words from conf's content phrases.
+func (conf *config) segmentDictionary() *segmentDictionary {
+	if conf.SegmentWords != nil {
+		return conf.SegmentWords
+	}
+	return builtinSegmentDictionary()
+}
+
+// addSegmentWords adds the parts of phrase that are in segmented scripts to
+// conf's segmentation dictionary, so that text that contains the phrase
+// will be split into words in a way that lets it match, even if the words
+// aren't in the built-in lists.
+func (conf *config) addSegmentWords(phrase string) {
+	if conf.SegmentWords == nil {
+		builtin := builtinSegmentDictionary()
+		conf.SegmentWords = &segmentDictionary{
+			words:  make(map[string]bool, len(builtin.words)),
+			maxLen: builtin.maxLen,
+		}
+		for w := range builtin.words {
+			conf.SegmentWords.words[w] = true
+		}
+	}
+
+	if conf.NormalizeText {
+		phrase = conf.normalizePhrase(phrase)
+	}
+	var run []rune
+	for _, r := range phrase + " " {
+		if segmentedScript(r) {
+			run = append(run, r)
+			continue
+		}
+		if len(run) > 0 {
+			conf.SegmentWords.add(string(run))
+			run = run[:0]
+		}
+	}
+}
+
+// segmentedScript reports whether r is in a script that is written without
+// spaces between words.
+func segmentedScript(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai) || r == 'ー'
+}
+
+// mergeUnknown reports whether unknown characters of r's script should be
+// kept together as one word, rather than treated as one-character words.
+// (Chinese characters are often words by themselves, but Thai letters and
+// katakana aren't.)
+func mergeUnknown(r rune) bool {
+	return unicode.In(r, unicode.Katakana, unicode.Thai) || r == 'ー'
+}
+
+// segmentBoundaries splits run (a sequence of characters in segmented
+// scripts) into words, using the fewest words from dict possible. It
+// returns the byte offsets of the ends of the words.
+func segmentBoundaries(dict *segmentDictionary, run []byte) []int {
+
+	offsets := make([]int, 0, len(run)/3+1)
+	for i := 0; i < len(run); {
+		offsets = append(offsets, i)
+		_, n := utf8.DecodeRune(run[i:])
+		i += n
+	}
+	offsets = append(offsets, len(run))
+	n := len(offsets) - 1
+
+	// cost[i] is the cost of the best segmentation of the first i
+	// characters, and start[i] is where its last word starts. A dictionary
+	// word costs 1, and a character that isn't in the dictionary costs 2.
+	// unknown[i] is whether the last word is made of unknown characters.
+	cost := make([]int, n+1)
+	start := make([]int, n+1)
+	unknown := make([]bool, n+1)
+	for i := 1; i <= n; i++ {
+		c := run[offsets[i-1]:offsets[i]]
+		switch {
+		case dict.words[string(c)]:
+			cost[i], start[i] = cost[i-1]+1, i-1
+		default:
+			cost[i], start[i], unknown[i] = cost[i-1]+2, i-1, true
+			if r, _ := utf8.DecodeRune(c); mergeUnknown(r) && unknown[i-1] {
+				prev, _ := utf8.DecodeRune(run[offsets[i-2]:])
+				if mergeUnknown(prev) {
+					start[i] = start[i-1]
+				}
+			}
+		}
+
+		for l := 2; l <= dict.maxLen && l <= i; l++ {
+			if dict.words[string(run[offsets[i-l]:offsets[i]])] && cost[i-l]+1 <= cost[i] {
+				cost[i], start[i], unknown[i] = cost[i-l]+1, i-l, false
+			}
+		}
+	}
+
+	var ends []int
+	for i := n; i > 0; i = start[i] {
+		ends = append(ends, offsets[i])
+	}
+	for i, j := 0, len(ends)-1; i < j; i, j = i+1, j-1 {
+		ends[i], ends[j] = ends[j], ends[i]
+	}
+	return ends
+}
+
+// segmentPhrase inserts spaces between the words of a phrase that are in
+// segmented scripts, and around them, so that the phrase will match only
+// whole words in the segmented page content.
+func segmentPhrase(dict *segmentDictionary, s string) string {
+	var b, run []byte
+	flush := func(next rune) {
+		if len(run) == 0 {
+			return
+		}
+		if len(b) == 0 || b[len(b)-1] != ' ' {
+			b = append(b, ' ')
+		}
+		start := 0
+		for _, end := range segmentBoundaries(dict, run) {
+			if start > 0 {
+				b = append(b, ' ')
+			}
+			b = append(b, run[start:end]...)
+			start = end
+		}
+		if next != ' ' {
+			b = append(b, ' ')
+		}
+		run = run[:0]
+	}
+
+	for _, r := range s {
+		if segmentedScript(r) {
+			run = utf8.AppendRune(run, r)
+			continue
+		}
+		flush(r)
+		b = utf8.AppendRune(b, r)
+	}
+	flush(0)
+	return string(b)
+}
+
+// phraseForm returns the form of a content phrase that is added to the
+// phrase list: normalized (if normalize-text is on), and segmented.
+func (conf *config) phraseForm(p string) string {
+	if conf.NormalizeText {
+		p = conf.normalizePhrase(p)
+	}
+	return segmentPhrase(conf.segmentDictionary(), p)
+}
+
+// segmentByte handles a byte of page content that is (or may be) part of a
+// non-ASCII character, collecting the text in segmented scripts so that it
+// can be split into words before it is passed on to the phrase scanner.
+func (cs *contentScanner) segmentByte(c byte) {
+	cs.partial = append(cs.partial, c)
+	if !utf8.FullRune(cs.partial) {
+		return
+	}
+	r, _ := utf8.DecodeRune(cs.partial)
+
+	if segmentedScript(r) {
+		if len(cs.run) == 0 && cs.prev != ' ' && cs.prev != 0 {
+			cs.scanWordByte(' ')
+		}
+		cs.run = append(cs.run, cs.partial...)
+		cs.partial = cs.partial[:0]
+		if len(cs.run) >= maxSegmentRun {
+			cs.flushRun()
+		}
+		return
+	}
+
+	if len(cs.run) > 0 {
+		cs.flushRun()
+		if r != ' ' {
+			cs.scanWordByte(' ')
+		}
+	}
+	for _, b := range cs.partial {
+		cs.scanWordByte(b)
+	}
+	cs.partial = cs.partial[:0]
+}
+
+// flushRun segments the collected text, and passes it on to the phrase
+// scanner with spaces between the words.
+func (cs *contentScanner) flushRun() {
+	if len(cs.run) == 0 {
+		return
+	}
+	start := 0
+	for _, end := range segmentBoundaries(cs.conf.segmentDictionary(), cs.run) {
+		if start > 0 {
+			cs.scanWordByte(' ')
+		}
+		for _, b := range cs.run[start:end] {
+			cs.scanWordByte(b)
+		}
+		start = end
+	}
+	cs.run = cs.run[:0]
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// A SOCKS5 proxy server (RFC 1928), for clients that can't use an HTTP proxy.
+// Each SOCKS connection is handled like an HTTP CONNECT request.
+
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded           = 0
+	socksNotAllowed          = 2
+	socksCmdNotSupported     = 7
+	socksAddrTypeUnsupported = 8
+)
+
+// socksSniffTimeout is how long to wait for the client to send data, to see
+// whether the connection is TLS, HTTP, or something else. (Some protocols
+// wait for the server to speak first.)
+const socksSniffTimeout = 2 * time.Second
+
+func runSOCKSServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-shutdownChan
+		ln.Close()
+	}()
+
+	ln = tcpKeepAliveListener{ln.(*net.TCPListener)}
+
+	var tempDelay time.Duration
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		go handleSOCKSConnection(conn)
+	}
+}
+
+func handleSOCKSConnection(conn net.Conn) {
+	activeConnections.Add(1)
+	defer activeConnections.Done()
+
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("SOCKS: panic serving connection from %v: %v\n%s", conn.RemoteAddr(), err, buf)
+			Lce(conn.Close())
+		}
+	}()
+
+	br := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	authUser, err := socksAuthenticate(br, conn)
+	if err != nil {
+		logVerbose("socks", "Error negotiating SOCKS authentication with %v: %v", conn.RemoteAddr(), err)
+		Lce(conn.Close())
+		return
+	}
+
+	target, err := socksReadRequest(br, conn)
+	if err != nil {
+		logVerbose("socks", "Error reading SOCKS request from %v: %v", conn.RemoteAddr(), err)
+		Lce(conn.Close())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if authUser == "" {
+		authUser = anonymousUser(client)
+	}
+	user := client
+	if authUser != "" {
+		user = authUser
+	}
+
+	r := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Header:     make(http.Header),
+		Proto:      "SOCKS5",
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	request := &Request{
+		Request:  r,
+		User:     authUser,
+		ClientIP: client,
+	}
+	filterRequest(request, true)
+	r = request.Request
+
+	if request.Action.Action == "require-auth" {
+		socksReply(conn, socksNotAllowed)
+		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+		Lce(conn.Close())
+		return
+	}
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		Lce(conn.Close())
+		return
+	}
+
+	// Look at the first bytes the client sends, to decide how to handle the
+	// connection.
+	conn.SetReadDeadline(time.Now().Add(socksSniffTimeout))
+	first, _ := br.Peek(8)
+	conn.SetReadDeadline(time.Time{})
+	hc := &hijackedConn{Conn: conn, Reader: br}
+
+	_, port, _ := net.SplitHostPort(target)
+
+	switch {
+	case len(first) > 0 && first[0] == 22:
+		// A TLS handshake record
+		SSLBump(hc, target, user, authUser, r)
+
+	case looksLikeHTTP(first):
+		server := &http.Server{
+			Handler: proxyHandler{
+				TLS:         false,
+				connectPort: port,
+				user:        authUser,
+			},
+			IdleTimeout: getConfig().CloseIdleConnections,
+		}
+		err := server.Serve(&singleListener{conn: hc})
+		if err != nil && err != io.EOF {
+			log.Print(fmt.Errorf("single server listener error: %s", err))
+		}
+
+	default:
+		logAccess(r, nil, 0, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+		switch request.Action.Action {
+		case "block", "block-invisible":
+			Lce(conn.Close())
+			return
+		}
+		upload, download := connectDirect(r.Context(), hc, target, nil, dialer)
+		logAccess(r, nil, upload+download, false, user, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+	}
+}
+
+// socksAuthenticate reads the client's greeting and performs the
+// authentication subnegotiation. It returns the authenticated username, if
+// any.
+func socksAuthenticate(br *bufio.Reader, conn net.Conn) (authUser string, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthPassword {
+			method = socksAuthPassword
+			break
+		}
+		if m == socksAuthNone {
+			method = socksAuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case socksAuthNone:
+		return "", nil
+	case socksAuthPassword:
+		// RFC 1929
+		var version, length byte
+		if version, err = br.ReadByte(); err != nil {
+			return "", err
+		}
+		if version != 1 {
+			return "", fmt.Errorf("unsupported username/password authentication version %d", version)
+		}
+		if length, err = br.ReadByte(); err != nil {
+			return "", err
+		}
+		username := make([]byte, length)
+		if _, err := io.ReadFull(br, username); err != nil {
+			return "", err
+		}
+		if length, err = br.ReadByte(); err != nil {
+			return "", err
+		}
+		password := make([]byte, length)
+		if _, err := io.ReadFull(br, password); err != nil {
+			return "", err
+		}
+
+		if !getConfig().ValidCredentials(string(username), string(password)) {
+			log.Printf("Incorrect username or password from %v: %s:%s", conn.RemoteAddr(), username, password)
+			conn.Write([]byte{1, 1})
+			return "", errors.New("authentication failed")
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+		return string(username), nil
+	default:
+		return "", errors.New("no acceptable authentication methods")
+	}
+}
+
+// socksReadRequest reads a SOCKS request, and returns the destination
+// address (host:port). Only the CONNECT command is supported.
+func socksReadRequest(br *bufio.Reader, conn net.Conn) (target string, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if header[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddrTypeUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	var port uint16
+	if err := binary.Read(br, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socksReply sends a reply to a SOCKS request. The bound address is always
+// reported as 0.0.0.0:0, since it is not meaningful when the connection to
+// the server may go through SSLBump.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// looksLikeHTTP returns whether data looks like the beginning of an HTTP
+// request (an uppercase method name followed by a space).
+func looksLikeHTTP(data []byte) bool {
+	for i, c := range data {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			continue
+		case c == ' ':
+			return i > 0
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Running as a Squid helper ("redwood -squid-helper=url_rewrite" or
+// "redwood -squid-helper=external_acl"), for sites that use Squid as their
+// proxy server. Requests come in on standard input, one per line, and the
+// replies go to standard output. If Squid is configured with concurrency,
+// each line starts with a channel ID, and requests are handled in parallel.
+
+// setSquidHelper validates the value of the squid-helper option.
+func (conf *config) setSquidHelper(mode string) error {
+	switch mode {
+	case "url_rewrite", "external_acl":
+		conf.SquidHelper = mode
+		return nil
+	}
+	return fmt.Errorf("invalid squid-helper mode %q (expected url_rewrite or external_acl)", mode)
+}
+
+// runSquidHelper reads helper requests from in, and writes the replies to
+// out, until in is closed.
+func runSquidHelper(in io.Reader, out io.Writer) {
+	conf := getConfig()
+	if conf.SquidHelper == "url_rewrite" && conf.SquidBlockURL == "" {
+		log.Fatal("squid-block-url must be set to use the url_rewrite helper")
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var outLock sync.Mutex
+	bw := bufio.NewWriter(out)
+	reply := func(channel, result string) {
+		outLock.Lock()
+		defer outLock.Unlock()
+		if channel != "" {
+			bw.WriteString(channel)
+			bw.WriteString(" ")
+		}
+		bw.WriteString(result)
+		bw.WriteString("\n")
+		if err := bw.Flush(); err != nil {
+			log.Fatal("Error writing helper reply: ", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		channel := ""
+		if len(fields) > 1 && isDigits(fields[0]) {
+			channel = fields[0]
+			fields = fields[1:]
+		}
+
+		if channel == "" {
+			// Without concurrency, Squid expects the replies in order.
+			reply(channel, squidHelperResult(fields))
+			continue
+		}
+		wg.Add(1)
+		go func(channel string, fields []string) {
+			defer wg.Done()
+			reply(channel, squidHelperResult(fields))
+		}(channel, fields)
+	}
+	wg.Wait()
+
+	if err := scanner.Err(); err != nil {
+		log.Println("Error reading helper requests:", err)
+	}
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// squidHelperResult handles one helper request, and returns the reply
+// (without the channel ID).
+func squidHelperResult(fields []string) (result string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Panic handling helper request %q: %v", fields, err)
+			result = "BH message=" + squidQuote(fmt.Sprint(err))
+		}
+	}()
+
+	conf := getConfig()
+
+	var rawURL, client, user, method string
+	switch conf.SquidHelper {
+	case "url_rewrite":
+		// URL, followed by the default url_rewrite_extras:
+		// client-IP/FQDN username method ...
+		rawURL = fields[0]
+		if len(fields) > 1 {
+			client, _, _ = strings.Cut(fields[1], "/")
+		}
+		if len(fields) > 2 {
+			user = fields[2]
+		}
+		if len(fields) > 3 {
+			method = fields[3]
+		}
+	case "external_acl":
+		// %>a %un %>rm %>ru
+		if len(fields) < 4 {
+			return "BH message=" + squidQuote("expected client IP, username, method, and URL")
+		}
+		client, user, method, rawURL = fields[0], fields[1], fields[2], fields[3]
+	}
+
+	if user == "-" {
+		user = ""
+	}
+	if user != "" {
+		// Squid URL-encodes usernames.
+		if u, err := url.QueryUnescape(user); err == nil {
+			user = u
+		}
+	}
+	if method == "" || method == "-" {
+		method = "GET"
+	}
+
+	r := &http.Request{
+		Method: method,
+		Header: make(http.Header),
+	}
+	if method == "CONNECT" {
+		r.URL = &url.URL{Host: rawURL}
+	} else {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			return "BH message=" + squidQuote("invalid URL: "+rawURL)
+		}
+		r.URL = u
+	}
+	r.Host = r.URL.Host
+	if client != "" && client != "-" {
+		r.RemoteAddr = net.JoinHostPort(client, "0")
+	} else {
+		client = ""
+	}
+
+	authUser := user
+	if authUser == "" && client != "" {
+		authUser = anonymousUser(client)
+	}
+	logUser := client
+	if authUser != "" {
+		logUser = authUser
+	}
+
+	request := &Request{
+		Request:  r,
+		User:     authUser,
+		ClientIP: client,
+	}
+	filterRequest(request, false)
+	r = request.Request
+	logAccess(r, nil, 0, false, logUser, request.Tally, request.Scores.data, request.Action, "", request.Ignored)
+
+	blocked := request.Action.Action == "block" || request.Action.Action == "block-invisible"
+
+	switch conf.SquidHelper {
+	case "external_acl":
+		if !blocked {
+			return "OK"
+		}
+		return fmt.Sprintf("ERR message=%s log=%s", squidQuote(conf.squidBlockReason(request.Action)), squidQuote(request.Action.Action+" "+request.Action.Conditions()))
+
+	default:
+		if blocked {
+			blockURL := conf.squidBlockURL(r, logUser, request.Action)
+			if method == "CONNECT" {
+				// A CONNECT request can't be redirected, so send it to the
+				// block page's server instead.
+				return "OK rewrite-url=" + squidQuote(hostWithPort(blockURL))
+			}
+			return "OK status=302 url=" + squidQuote(blockURL.String())
+		}
+		if method != "CONNECT" && conf.changeQuery(r.URL) {
+			return "OK rewrite-url=" + squidQuote(r.URL.String())
+		}
+		return "ERR"
+	}
+}
+
+// squidBlockReason returns a description of why a request was blocked by
+// rule.
+func (conf *config) squidBlockReason(rule ACLActionRule) string {
+	if rule.Description != "" {
+		return rule.Description
+	}
+	return strings.Join(conf.aclDescriptions(rule), ", ")
+}
+
+// squidBlockURL returns the URL of the block page for r, with the details
+// of why it was blocked added to the query string.
+func (conf *config) squidBlockURL(r *http.Request, user string, rule ACLActionRule) *url.URL {
+	u, err := url.Parse(conf.SquidBlockURL)
+	if err != nil {
+		log.Printf("Invalid squid-block-url %q: %v", conf.SquidBlockURL, err)
+		u = new(url.URL)
+	}
+	q := u.Query()
+	q.Set("url", r.URL.String())
+	q.Set("user", user)
+	if categories := conf.aclDescriptions(rule); len(categories) > 0 {
+		q.Set("category", categories[0])
+	}
+	q.Set("reason", conf.squidBlockReason(rule))
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// hostWithPort returns the host:port address of the server in u.
+func hostWithPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return net.JoinHostPort(u.Hostname(), "443")
+}
+
+// squidQuote quotes a value for a helper reply.
+func squidQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", " ")
+	return `"` + s + `"`
+}
@@ -0,0 +1,293 @@
+package main
+
+// Streaming phrase scan, for responses that are too big to buffer
+// (longer than max-content-scan-size).
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// A scanningBody is a response body that is checked while it is being copied
+// to the client, so that the response may be blocked partway through.
+type scanningBody interface {
+	copyTo(w http.ResponseWriter) (n int64, blocked ACLActionRule, err error)
+}
+
+// A streamScanner phrase-scans a response body while it is being copied to
+// the client. It holds back the last StreamScanWindow bytes it has read, so
+// that if the page is blocked partway through, the content that caused it
+// to be blocked doesn't reach the client.
+type streamScanner struct {
+	io.ReadCloser // the original response body
+
+	response *Response
+	body     io.Reader // the decompressed body
+	window   int
+
+	// chunked is whether the original response had no Content-Length.
+	chunked bool
+
+	scanner *contentScanner
+	sw      *scanWriter
+	writer  io.WriteCloser // scans what is written to it
+}
+
+// canStreamScan returns whether the phrase scan for response (which was too
+// big to scan normally) should be done while streaming it to the client.
+func canStreamScan(response *Response) bool {
+	conf := getConfig()
+	if !conf.StreamScan || response.Request.Request.Method == "HEAD" {
+		return false
+	}
+	// JavaScript is scanned by lexing it, and documents like PDFs have their
+	// text extracted; both require the whole file.
+	contentType := response.Response.Header.Get("Content-Type")
+	if strings.Contains(contentType, "javascript") || documentExtractor(nil, contentType) != nil {
+		return false
+	}
+	switch response.Response.Header.Get("Content-Encoding") {
+	case "", "br", "deflate", "gzip":
+		return true
+	}
+	return false
+}
+
+// startStreamScan sets up response to be phrase-scanned as it is sent to the
+// client. The body is decompressed, since the scan needs the uncompressed
+// content.
+func startStreamScan(response *Response) error {
+	resp := response.Response
+	s := &streamScanner{
+		ReadCloser: resp.Body,
+		response:   response,
+		body:       resp.Body,
+		window:     getConfig().StreamScanWindow,
+		chunked:    resp.ContentLength == -1,
+	}
+
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		body, err := decompressReader(ce, resp.Body)
+		if err != nil {
+			return err
+		}
+		s.body = body
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Body = s
+	return nil
+}
+
+// decompressReader returns a Reader that decompresses r according to the
+// Content-Encoding ce.
+func decompressReader(ce string, r io.Reader) (io.Reader, error) {
+	switch ce {
+	case "br":
+		return brotli.NewReader(r), nil
+	case "deflate":
+		return flate.NewReader(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", ce)
+}
+
+// Read reads the decompressed body, without scanning it.
+func (s *streamScanner) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+// isStreamScanned returns whether resp's body is being phrase-scanned while
+// it is streamed.
+func isStreamScanned(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	_, ok := resp.Body.(*streamScanner)
+	return ok
+}
+
+// start creates the phrase scanner, using the first chunk of content to
+// detect the charset.
+func (s *streamScanner) start(first []byte) {
+	conf := getConfig()
+	tally := s.response.Tally
+	contentType := s.response.Response.Header.Get("Content-Type")
+	_, cs, _ := charset.DetermineEncoding(first, contentType)
+
+	s.scanner = conf.newContentScanner(tally)
+	s.scanner.scanByte(' ')
+	s.sw = &scanWriter{ps: s.scanner}
+	if len(conf.ContentRegexes.rules) > 0 {
+		s.sw.regexes = conf.ContentRegexes
+		s.sw.tally = tally
+	}
+	s.writer = transform.NewWriter(s.sw, conf.contentTransformer(contentType, cs, nil))
+}
+
+// streamRegexChunk is how much text is collected before it is checked
+// against the content regexes, when stream-scanning.
+const streamRegexChunk = 64 * 1024
+
+// A scanWriter feeds the data written to it to a contentScanner, and (if
+// regexes is set) to the content regexes.
+type scanWriter struct {
+	ps *contentScanner
+
+	regexes *regexMap
+	tally   map[rule]int
+	text    []byte // text that hasn't been checked against the regexes yet
+}
+
+func (w *scanWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		w.ps.scanByte(c)
+	}
+	if w.regexes != nil {
+		w.text = append(w.text, p...)
+		if len(w.text) >= streamRegexChunk {
+			// Check the text up to the last word break, so that words
+			// aren't split between chunks.
+			cut := bytes.LastIndexByte(w.text, ' ')
+			if cut <= 0 {
+				cut = len(w.text)
+			}
+			w.regexes.countMatches(string(w.text[:cut]), w.tally)
+			w.text = append(w.text[:0], w.text[cut:]...)
+		}
+	}
+	return len(p), nil
+}
+
+// flush checks the rest of the text against the content regexes.
+func (w *scanWriter) flush() {
+	if w.regexes != nil && len(w.text) > 0 {
+		w.regexes.countMatches(string(w.text), w.tally)
+		w.text = nil
+	}
+}
+
+// blockAction returns the action that should be taken, based on the
+// rules that have matched the content so far. It returns an empty rule if the
+// response isn't blocked.
+func (response *Response) blockAction() ACLActionRule {
+	if len(response.Action.Needed) == 1 && response.Action.Needed[0] == "starlark" {
+		// The action was set by a script.
+		return ACLActionRule{}
+	}
+
+	conf := getConfig()
+	response.Scores.data = conf.categoryScores(response.Tally)
+	ar, ignored := conf.ChooseACLCategoryAction(response.ACLs.data, response.Scores.data, conf.Threshold, response.PossibleActions...)
+	switch ar.Action {
+	case "block", "block-invisible":
+		response.Action, response.Ignored = ar, ignored
+		return ar
+	}
+	return ACLActionRule{}
+}
+
+// copyTo scans the response body while copying it to w. If the response is
+// blocked before anything has been sent, it returns the block rule without
+// writing to w, so that a block page can be shown. If it is blocked after
+// that, the response is cut off.
+func (s *streamScanner) copyTo(w http.ResponseWriter) (n int64, blocked ACLActionRule, err error) {
+	var pending []byte
+	headerSent := false
+	buf := make([]byte, 32*1024)
+
+	send := func(data []byte) error {
+		if !headerSent {
+			copyResponseHeader(w, s.response.Response)
+			headerSent = true
+		}
+		written, err := w.Write(data)
+		n += int64(written)
+		return err
+	}
+
+	for {
+		nr, rerr := s.body.Read(buf)
+		if nr > 0 {
+			chunk := buf[:nr]
+			if s.scanner == nil {
+				s.start(chunk)
+			}
+			s.writer.Write(chunk)
+			pending = append(pending, chunk...)
+
+			if ar := s.response.blockAction(); ar.Action != "" {
+				if !headerSent {
+					return n, ar, nil
+				}
+				s.cutOff(w, ar)
+				return n, ar, nil
+			}
+
+			if len(pending) > s.window {
+				toSend := len(pending) - s.window
+				if err := send(pending[:toSend]); err != nil {
+					return n, ACLActionRule{}, err
+				}
+				pending = append(pending[:0], pending[toSend:]...)
+			}
+		}
+
+		// Servers that use broken chunked Transfer-Encoding can give us
+		// unexpected EOFs, even if we got all the content.
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF && s.chunked {
+			break
+		}
+		if rerr != nil {
+			return n, ACLActionRule{}, rerr
+		}
+	}
+
+	if s.scanner != nil {
+		s.writer.Close()
+		s.scanner.scanByte(' ')
+		s.scanner.finish()
+		s.sw.flush()
+		if ar := s.response.blockAction(); ar.Action != "" {
+			if !headerSent {
+				return n, ar, nil
+			}
+			s.cutOff(w, ar)
+			return n, ar, nil
+		}
+	}
+
+	err = send(pending)
+	return n, ACLActionRule{}, err
+}
+
+// cutOff ends a response that was blocked after part of it had already been
+// sent. HTML pages get a note saying that the rest of the page was blocked.
+// The response is then aborted, so that the client can tell that it is
+// incomplete.
+func (s *streamScanner) cutOff(w http.ResponseWriter, ar ACLActionRule) {
+	if strings.Contains(s.response.Response.Header.Get("Content-Type"), "html") {
+		reason := ar.Description
+		if reason == "" {
+			reason = strings.Join(getConfig().aclDescriptions(ar), ", ")
+		}
+		fmt.Fprintf(w, `<div style="clear:both;padding:1em;border:2px solid #c00;background:#fff;color:#c00">The rest of this page was blocked (%s).</div>`, html.EscapeString(reason))
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	log.Printf("Cut off streamed response from %v: %s %s", s.response.Request.Request.URL, ar.Action, ar.Conditions())
+}
@@ -59,15 +59,73 @@ func ParseTimeRange(s string) (r TimeRange, err error) {
 	return r, nil
 }
 
+// A DateRange is a range of calendar dates, inclusive at both ends.
+type DateRange struct {
+	First, Last civilDate
+}
+
+// A civilDate is a date without a time zone, which can be compared with
+// other dates by its numeric value.
+type civilDate int
+
+func makeCivilDate(year int, month time.Month, day int) civilDate {
+	return civilDate(year*10000 + int(month)*100 + day)
+}
+
+// ParseDateRange parses a date range in the format yyyy-mm-dd..yyyy-mm-dd,
+// or a single date in the format yyyy-mm-dd.
+func ParseDateRange(s string) (r DateRange, err error) {
+	first, last := s, s
+	if dots := strings.Index(s, ".."); dots != -1 {
+		first, last = s[:dots], s[dots+2:]
+	}
+
+	f, err := time.Parse("2006-01-02", first)
+	if err != nil {
+		return DateRange{}, fmt.Errorf("invalid date range %q", s)
+	}
+	l, err := time.Parse("2006-01-02", last)
+	if err != nil {
+		return DateRange{}, fmt.Errorf("invalid date range %q", s)
+	}
+
+	r.First = makeCivilDate(f.Date())
+	r.Last = makeCivilDate(l.Date())
+	if r.First > r.Last {
+		return DateRange{}, fmt.Errorf("invalid date range %q (the end is before the beginning)", s)
+	}
+	return r, nil
+}
+
 // A WeeklySchedule is a set of time periods, occurring on certain days of the
-// week and repeating each week.
+// week and repeating each week. It may be limited to certain ranges of dates,
+// or to the events in an iCalendar file, and may exclude the events in other
+// calendar files.
 type WeeklySchedule struct {
 	Days  [7]bool
 	Times []TimeRange
+
+	// Location is the time zone that the schedule is evaluated in.
+	// If it is nil, the server's local time zone is used.
+	Location *time.Location
+
+	// Dates, if it is not empty, limits the schedule to the listed dates.
+	Dates []DateRange
+
+	// Calendars, if it is not empty, limits the schedule to times when an
+	// event is in progress in at least one of the calendars.
+	Calendars []*icsCalendar
+
+	// ExcludedCalendars lists calendars (such as holiday lists) whose events
+	// suspend the schedule.
+	ExcludedCalendars []*icsCalendar
 }
 
 // ParseWeeklySchedule reads an optional weekday list, and any number of
-// TimeRanges, into a WeeklySchedule.
+// TimeRanges, into a WeeklySchedule. It also accepts date ranges
+// (yyyy-mm-dd..yyyy-mm-dd), a time zone (tz=America/Chicago), and iCalendar
+// files whose events the schedule is limited to (calendar=/path/terms.ics)
+// or suspended during (!calendar=/path/holidays.ics).
 func ParseWeeklySchedule(src []string) (schedule WeeklySchedule, err error) {
 	if len(src) == 0 {
 		return WeeklySchedule{}, errors.New("no data")
@@ -85,12 +143,35 @@ func ParseWeeklySchedule(src []string) (schedule WeeklySchedule, err error) {
 		}
 	}
 
-	for _, times := range src {
-		tr, err := ParseTimeRange(times)
-		if err != nil {
-			return WeeklySchedule{}, err
+	for _, item := range src {
+		switch {
+		case strings.HasPrefix(item, "tz="):
+			loc, err := time.LoadLocation(strings.TrimPrefix(item, "tz="))
+			if err != nil {
+				return WeeklySchedule{}, fmt.Errorf("invalid time zone in %q: %v", item, err)
+			}
+			schedule.Location = loc
+
+		case strings.HasPrefix(item, "calendar="):
+			schedule.Calendars = append(schedule.Calendars, loadICSCalendar(strings.TrimPrefix(item, "calendar=")))
+
+		case strings.HasPrefix(item, "!calendar="):
+			schedule.ExcludedCalendars = append(schedule.ExcludedCalendars, loadICSCalendar(strings.TrimPrefix(item, "!calendar=")))
+
+		case strings.Contains(item, ":"):
+			tr, err := ParseTimeRange(item)
+			if err != nil {
+				return WeeklySchedule{}, err
+			}
+			schedule.Times = append(schedule.Times, tr)
+
+		default:
+			dr, err := ParseDateRange(item)
+			if err != nil {
+				return WeeklySchedule{}, err
+			}
+			schedule.Dates = append(schedule.Dates, dr)
 		}
-		schedule.Times = append(schedule.Times, tr)
 	}
 
 	return schedule, nil
@@ -115,3 +196,51 @@ func (w WeeklySchedule) Contains(day time.Weekday, hour int, min int) bool {
 
 	return false
 }
+
+// Matches returns whether t falls within the schedule, taking into account
+// its time zone, date ranges, and calendars.
+func (w WeeklySchedule) Matches(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	}
+
+	h, m, _ := t.Clock()
+	if !w.Contains(t.Weekday(), h, m) {
+		return false
+	}
+
+	if len(w.Dates) > 0 {
+		today := makeCivilDate(t.Date())
+		inRange := false
+		for _, dr := range w.Dates {
+			if dr.First <= today && today <= dr.Last {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	if len(w.Calendars) > 0 {
+		inEvent := false
+		for _, c := range w.Calendars {
+			if c.Contains(t) {
+				inEvent = true
+				break
+			}
+		}
+		if !inEvent {
+			return false
+		}
+	}
+
+	for _, c := range w.ExcludedCalendars {
+		if c.Contains(t) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -60,12 +60,13 @@ func (conf *config) loadCertificate() {
 }
 
 // connectDirect connects to serverAddr and copies data between it and conn.
-// extraData is sent to the server first.
-func connectDirect(conn net.Conn, serverAddr string, extraData []byte, dialer *net.Dialer) (uploaded, downloaded int64) {
+// extraData is sent to the server first. If ctx contains the resolved
+// addresses for serverAddr, they are used instead of looking it up again.
+func connectDirect(ctx context.Context, conn net.Conn, serverAddr string, extraData []byte, dialer *net.Dialer) (uploaded, downloaded int64) {
 	activeConnections.Add(1)
 	defer activeConnections.Done()
 
-	serverConn, err := dialer.Dial("tcp", serverAddr)
+	serverConn, err := dialPinned(ctx, dialer, "tcp", serverAddr)
 	if err != nil {
 		log.Printf("error with pass-through of SSL connection to %s: %s", serverAddr, err)
 		conn.Close()
@@ -133,7 +134,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	// just the address).
 	clientHello, err := readClientHello(conn)
 	if err != nil {
-		session.Errorf("error reading client hello: %v", err, false, "")
+		session.Errorf("error reading client hello: %v", err, false)
 		if _, ok := err.(net.Error); ok {
 			Lce(conn.Close())
 			return
@@ -189,7 +190,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	}
 
 	if serverName == "" {
-		session.Error(errors.New("no SNI available"), false, "")
+		session.Error(errors.New("no SNI available"), false)
 		Lce(conn.Close())
 		return
 	}
@@ -209,19 +210,34 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		log.Printf("Error generating TLS fingerprint: %v", err)
 	} else {
 		tlsFingerprint = j.GetJA3Hash()
+		session.JA3 = tlsFingerprint
 		ctx := cr.Context()
 		ctx = context.WithValue(ctx, tlsFingerprintKey{}, tlsFingerprint)
 		cr = cr.WithContext(ctx)
 	}
+	if clientHelloInfo != nil {
+		session.clientHello = clientHelloInfo
+		session.JA4 = clientHelloInfo.JA4()
+		cr = cr.WithContext(context.WithValue(cr.Context(), clientHelloKey{}, clientHelloInfo))
+	}
+
+	// Evaluate server-ip ACLs with the address we will actually connect to,
+	// not the SNI.
+	cr = getConfig().ACLs.withResolvedDestination(cr, hostOnly(session.ServerAddr))
 
 	var tally map[rule]int
 	var scores map[string]int
 	var reqACLs map[string]bool
+	originalACLs := make(map[string]bool)
 	{
 		conf := getConfig()
 		tally = conf.URLRules.MatchingRules(cr.URL)
 		scores = conf.categoryScores(tally)
 		reqACLs = conf.ACLs.requestACLs(cr, authUser)
+		for acl := range reqACLs {
+			originalACLs[acl] = true
+		}
+		conf.applyQuotas(reqACLs, scores, user)
 		if invalidSSL {
 			reqACLs["invalid-ssl"] = true
 		}
@@ -230,12 +246,40 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	session.Scores.data = scores
 	session.PossibleActions = []string{"allow", "block"}
 	if getConfig().TLSReady && !obsoleteVersion && !invalidSSL {
-		session.PossibleActions = append(session.PossibleActions, "ssl-bump")
+		if pinning.learned(session.SNI, session.pinningFingerprint()) {
+			// Clients like this one have rejected our certificate for this
+			// site before.
+			session.ACLs.data["pinned"] = true
+		} else {
+			session.PossibleActions = append(session.PossibleActions, "ssl-bump")
+		}
 	}
 
+	originalServerAddr := session.ServerAddr
 	callStarlarkFunctions("ssl_bump", session)
 	sslBump(session)
 
+	if session.ServerAddr != originalServerAddr {
+		// The destination was changed by a script, so the ACLs are
+		// recomputed with the new destination's addresses. ACLs that only the
+		// old addresses matched are removed, and ones that the new addresses
+		// match are added; other changes that the script made are kept.
+		conf := getConfig()
+		cr = conf.ACLs.withResolvedDestination(cr, hostOnly(session.ServerAddr))
+		newACLs := conf.ACLs.requestACLs(cr, authUser)
+		for acl := range originalACLs {
+			if !newACLs[acl] {
+				delete(session.ACLs.data, acl)
+			}
+		}
+		for acl := range newACLs {
+			if !originalACLs[acl] {
+				session.ACLs.data[acl] = true
+			}
+		}
+	}
+	ctx := cr.Context()
+
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -248,12 +292,22 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	}
 
 	session.chooseAction()
+	ctx = withParentProxy(ctx, getConfig().chooseParentProxy(session.ACLs.data))
 
 	logAccess(cr, nil, 0, false, user, tally, scores, session.Action, "", session.Ignored)
 
+	if clientHelloInfo != nil && clientHelloInfo.ECH {
+		session.ECHStatus = echStatus(session.Action.Action)
+		if session.Action.Action != "ssl-bump" {
+			// This connection won't get another line in the TLS log, but it
+			// needs to be recorded that the real server name is unknown.
+			logTLS(user, session.ServerAddr, serverName, nil, false, session)
+		}
+	}
+
 	switch session.Action.Action {
 	case "allow", "":
-		upload, download := connectDirect(conn, session.ServerAddr, clientHello, dialer)
+		upload, download := connectDirect(ctx, conn, session.ServerAddr, clientHello, dialer)
 		logAccess(cr, nil, upload+download, false, user, tally, scores, session.Action, "", session.Ignored)
 		return
 	case "block":
@@ -264,6 +318,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	var cert tls.Certificate
 	var rt http.RoundTripper
 	var http2Support bool
+	var resolved *resolvedServer
 
 	closeChan := make(chan struct{})
 	server := &http.Server{
@@ -292,7 +347,7 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		serverConnConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
 
-	serverConn, err := tls.DialWithDialer(dialer, "tcp", session.ServerAddr, serverConnConfig)
+	serverConn, ja4sFingerprint, err := dialTLSPinnedRecording(ctx, dialer, "tcp", session.ServerAddr, serverConnConfig, true)
 	if err == nil {
 		defer func(serverConn *tls.Conn) {
 			err := serverConn.Close()
@@ -300,28 +355,27 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 		}(serverConn)
 		state := serverConn.ConnectionState()
 		serverCert := state.PeerCertificates[0]
+		resolved = resolvedServerFromContext(ctx)
+		session.JA4S = ja4sFingerprint
 
 		valid := validCert(serverCert, state.PeerCertificates[1:])
 		cert, err = imitateCertificate(serverCert, !valid, session.SNI)
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, tlsFingerprint)
-			connectDirect(conn, session.ServerAddr, clientHello, dialer)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, session)
+			connectDirect(ctx, conn, session.ServerAddr, clientHello, dialer)
 			return
 		}
 
 		http2Support = state.NegotiatedProtocol == "h2" && state.NegotiatedProtocolIsMutual
 
-		d := &tls.Dialer{
-			NetDialer: dialer,
-			Config: &tls.Config{
-				ServerName: session.SNI,
-				RootCAs:    certPoolWith(serverConn.ConnectionState().PeerCertificates),
-			},
+		redialConfig := &tls.Config{
+			ServerName: session.SNI,
+			RootCAs:    certPoolWith(serverConn.ConnectionState().PeerCertificates),
 		}
 		if !valid {
-			d.Config.InsecureSkipVerify = true
+			redialConfig.InsecureSkipVerify = true
 			originalCert := serverConn.ConnectionState().PeerCertificates[0]
-			d.Config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			redialConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
 				cert, err := x509.ParseCertificate(rawCerts[0])
 				if err != nil {
 					return err
@@ -333,8 +387,12 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 			}
 		}
 
+		redial := func(ctx context.Context) (net.Conn, error) {
+			return dialTLSPinned(ctx, dialer, "tcp", session.ServerAddr, redialConfig)
+		}
+
 		if http2Support {
-			d.Config.NextProtos = []string{"h2"}
+			redialConfig.NextProtos = []string{"h2"}
 
 			var once sync.Once
 			rt = &http2.Transport{
@@ -347,9 +405,9 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 						return c, nil
 					}
 					logVerbose("redial", "Redialing HTTP/2 connection to %s (%s)", session.SNI, session.ServerAddr)
-					return d.Dial("tcp", session.ServerAddr)
+					return redial(ctx)
 				},
-				TLSClientConfig:            d.Config,
+				TLSClientConfig:            redialConfig,
 				StrictMaxConcurrentStreams: true,
 			}
 		} else {
@@ -357,14 +415,14 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 				Conn: serverConn,
 				Redial: func(ctx context.Context) (net.Conn, error) {
 					logVerbose("redial", "Redialing connection to %s (%s)", session.SNI, session.ServerAddr)
-					return d.DialContext(ctx, "tcp", session.ServerAddr)
+					return redial(ctx)
 				},
 			}
 		}
 	} else {
 		cert, err = fakeCertificate(session.SNI)
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, tlsFingerprint)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error generating certificate: %v", err), false, session)
 			err = conn.Close()
 			if err != nil {
 				log.Print(fmt.Errorf("error generating certificate: unable to close connection: %s", err))
@@ -377,9 +435,11 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	server.Handler = &proxyHandler{
 		TLS:            true,
 		tlsFingerprint: tlsFingerprint,
+		clientHello:    clientHelloInfo,
 		connectPort:    port,
 		user:           authUser,
 		rt:             rt,
+		resolved:       resolved,
 	}
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert, getConfig().TLSCert},
@@ -397,20 +457,24 @@ func SSLBump(conn net.Conn, serverAddr, user, authUser string, r *http.Request)
 	tlsConn := tls.Server(&insertingConn{conn, clientHello}, tlsConfig)
 	err = tlsConn.Handshake()
 	if err != nil {
-		logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: %v", err), false, tlsFingerprint)
+		if isPinningFailure(err) && session.ECHStatus == "" {
+			pinning.recordFailure(session.SNI, session.pinningFingerprint(), session.ClientIP, err)
+		}
+		logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: %v", err), false, session)
 		err := conn.Close()
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: unable to close connection: %s", err), false, tlsFingerprint)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in handshake with client: unable to close connection: %s", err), false, session)
 		}
 		return
 	}
 
-	logTLS(user, session.ServerAddr, serverName, nil, false, tlsFingerprint)
+	logTLS(user, session.ServerAddr, serverName, nil, false, session)
+	pinning.recordSuccess(session.SNI, session.pinningFingerprint(), session.ClientIP)
 
 	if http2Downstream {
 		err := http2.ConfigureServer(server, nil)
 		if err != nil {
-			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in http2Downstream configuration: %s", err), false, tlsFingerprint)
+			logTLS(user, session.ServerAddr, serverName, fmt.Errorf("error in http2Downstream configuration: %s", err), false, session)
 		}
 	}
 	listener := &singleListener{conn: tlsConn}
@@ -431,6 +495,16 @@ type TLSSession struct {
 	// the upstream connection.
 	SourceIP net.IP
 
+	// JA3, JA4, and JA4S are TLS fingerprints of the client and server.
+	// (JA4S is not available until the upstream connection is made.)
+	JA3, JA4, JA4S string
+
+	// ECHStatus describes how a connection that used Encrypted Client Hello
+	// was handled, since the SNI is only the outer (public) name.
+	ECHStatus string
+
+	clientHello *clientHelloInfo
+
 	scoresAndACLs
 
 	frozen bool
@@ -499,7 +573,7 @@ func (s *TLSSession) Hash() (uint32, error) {
 	return 0, errors.New("unhashable type: TLSSession")
 }
 
-var tlsSessionAttrNames = []string{"sni", "server_addr", "user", "client_ip", "acls", "scores", "source_ip", "action", "possible_actions"}
+var tlsSessionAttrNames = []string{"sni", "server_addr", "user", "client_ip", "acls", "scores", "source_ip", "action", "possible_actions", "ja3", "ja4", "tls_versions", "cipher_suites", "ech", "post_quantum"}
 
 func (s *TLSSession) AttrNames() []string {
 	return tlsSessionAttrNames
@@ -526,6 +600,24 @@ func (s *TLSSession) Attr(name string) (starlark.Value, error) {
 		return starlark.String(ar.Action), nil
 	case "possible_actions":
 		return stringTuple(s.PossibleActions), nil
+	case "ja3":
+		return starlark.String(s.JA3), nil
+	case "ja4":
+		return starlark.String(s.JA4), nil
+	case "tls_versions":
+		if s.clientHello == nil {
+			return starlark.Tuple{}, nil
+		}
+		return stringTuple(s.clientHello.TLSVersions()), nil
+	case "cipher_suites":
+		if s.clientHello == nil {
+			return starlark.Tuple{}, nil
+		}
+		return stringTuple(s.clientHello.CipherSuiteNames()), nil
+	case "ech":
+		return starlark.Bool(s.clientHello != nil && s.clientHello.ECH), nil
+	case "post_quantum":
+		return starlark.Bool(s.clientHello != nil && s.clientHello.PostQuantum()), nil
 
 	default:
 		return nil, nil
@@ -866,15 +958,17 @@ func readClientHello(conn net.Conn) (hello []byte, err error) {
 }
 
 // parseClientHello parses some useful information out of a ClientHello message.
-// It returns a ClientHelloInfo with only the following fields filled in:
-// ServerName and SupportedProtocols.
-func parseClientHello(data []byte) (*tls.ClientHelloInfo, error) {
+// Of the fields in the embedded ClientHelloInfo, it fills in ServerName,
+// SupportedProtos, CipherSuites, SupportedVersions, SupportedCurves, and
+// SignatureSchemes.
+func parseClientHello(data []byte) (*clientHelloInfo, error) {
 	// The implementation of this function is based on crypto/tls.clientHelloMsg.unmarshal
-	var info tls.ClientHelloInfo
+	var info clientHelloInfo
 	s := cryptobyte.String(data)
 
-	// Skip message type, length, version, and random.
-	if !s.Skip(43) {
+	// Skip record header and message type and length; read the version;
+	// skip random.
+	if !s.Skip(9) || !s.ReadUint16(&info.Version) || !s.Skip(32) {
 		return nil, errors.New("too short")
 	}
 
@@ -887,6 +981,13 @@ func parseClientHello(data []byte) (*tls.ClientHelloInfo, error) {
 	if !s.ReadUint16LengthPrefixed(&cipherSuites) {
 		return nil, errors.New("bad cipher suites")
 	}
+	for !cipherSuites.Empty() {
+		var suite uint16
+		if !cipherSuites.ReadUint16(&suite) {
+			return nil, errors.New("bad cipher suites")
+		}
+		info.CipherSuites = append(info.CipherSuites, suite)
+	}
 
 	var compressionMethods cryptobyte.String
 	if !s.ReadUint8LengthPrefixed(&compressionMethods) {
@@ -909,6 +1010,7 @@ func parseClientHello(data []byte) (*tls.ClientHelloInfo, error) {
 		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
 			return nil, errors.New("bad extension")
 		}
+		info.Extensions = append(info.Extensions, extension)
 
 		switch extension {
 		case 0: // server name
@@ -934,6 +1036,32 @@ func parseClientHello(data []byte) (*tls.ClientHelloInfo, error) {
 				}
 			}
 
+		case 10: // supported groups
+			var curves cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&curves) || curves.Empty() {
+				return nil, errors.New("bad supported groups")
+			}
+			for !curves.Empty() {
+				var curve uint16
+				if !curves.ReadUint16(&curve) {
+					return nil, errors.New("bad supported groups")
+				}
+				info.SupportedCurves = append(info.SupportedCurves, tls.CurveID(curve))
+			}
+
+		case 13: // signature algorithms
+			var sigAndAlgs cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&sigAndAlgs) || sigAndAlgs.Empty() {
+				return nil, errors.New("bad signature algorithms")
+			}
+			for !sigAndAlgs.Empty() {
+				var sigAndAlg uint16
+				if !sigAndAlgs.ReadUint16(&sigAndAlg) {
+					return nil, errors.New("bad signature algorithms")
+				}
+				info.SignatureSchemes = append(info.SignatureSchemes, tls.SignatureScheme(sigAndAlg))
+			}
+
 		case 16: // ALPN
 			var protoList cryptobyte.String
 			if !extData.ReadUint16LengthPrefixed(&protoList) || protoList.Empty() {
@@ -947,6 +1075,37 @@ func parseClientHello(data []byte) (*tls.ClientHelloInfo, error) {
 				info.SupportedProtos = append(info.SupportedProtos, string(proto))
 			}
 
+		case 43: // supported versions
+			var versList cryptobyte.String
+			if !extData.ReadUint8LengthPrefixed(&versList) || versList.Empty() {
+				return nil, errors.New("bad supported versions")
+			}
+			for !versList.Empty() {
+				var vers uint16
+				if !versList.ReadUint16(&vers) {
+					return nil, errors.New("bad supported versions")
+				}
+				info.SupportedVersions = append(info.SupportedVersions, vers)
+			}
+
+		case 51: // key share
+			var clientShares cryptobyte.String
+			if !extData.ReadUint16LengthPrefixed(&clientShares) {
+				return nil, errors.New("bad key shares")
+			}
+			for !clientShares.Empty() {
+				var group uint16
+				var key cryptobyte.String
+				if !clientShares.ReadUint16(&group) || !clientShares.ReadUint16LengthPrefixed(&key) {
+					return nil, errors.New("bad key share")
+				}
+				info.KeyShares = append(info.KeyShares, tls.CurveID(group))
+			}
+
+		case extensionEncryptedClientHello:
+			info.ECH = true
+			continue
+
 		default:
 			// ignore
 			continue
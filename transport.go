@@ -11,8 +11,12 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,21 +30,165 @@ var dialer = &net.Dialer{
 	DualStack: true,
 }
 
-var httpTransport = &http.Transport{
-	Proxy:                 http.ProxyFromEnvironment,
-	DialContext:           dialer.DialContext,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 1 * time.Second,
-	DisableKeepAlives:     true,
+// httpTransport is the shared, pooled transport for requests that aren't
+// tied to a particular server connection (plain HTTP, and HTTPS requests
+// that aren't going through an SSLBump connection). Connections are kept
+// alive and reused across clients; HTTPS connections use HTTP/2 when the
+// server supports it (and http2-upstream is enabled), so many requests can
+// share one connection.
+var httpTransport = &pooledTransport{transport: newUpstreamTransport()}
+
+// newUpstreamTransport returns a new http.Transport for httpTransport, with
+// the default connection-pool settings.
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			if conf := getConfig(); conf != nil && len(conf.ParentProxies) > 0 {
+				// The parent-proxy settings (including direct) take the
+				// place of the environment variables.
+				return parentProxyFromContext(req.Context()), nil
+			}
+			return http.ProxyFromEnvironment(req)
+		},
+		// The Transport handles the parent proxy itself (so that plain HTTP
+		// requests can be sent to it without CONNECT), so it needs a dial
+		// function that doesn't.
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialDirectPinned(ctx, dialer, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return upstreamStats.track(conn), nil
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   8,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// configureUpstreamTransport applies the connection-pool settings from conf
+// to httpTransport. It is called at startup and whenever the configuration
+// is reloaded. Since an http.Transport can't be changed while it is in use,
+// it replaces the transport with a new one; requests in progress finish on
+// the old one, and its idle connections are closed.
+func configureUpstreamTransport(conf *config) {
+	t := newUpstreamTransport()
+	if conf.CloseIdleConnections > 0 {
+		t.IdleConnTimeout = conf.CloseIdleConnections
+	}
+	t.MaxConnsPerHost = conf.MaxConnectionsPerHost
+	t.MaxIdleConnsPerHost = conf.MaxIdleConnectionsPerHost
+	if t.MaxIdleConnsPerHost == 0 {
+		// Zero would mean http.DefaultMaxIdleConnsPerHost, not no limit.
+		t.DisableKeepAlives = true
+	}
+	t.ForceAttemptHTTP2 = conf.HTTP2Upstream
+
+	httpTransport.lock.Lock()
+	old := httpTransport.transport
+	httpTransport.transport = t
+	httpTransport.lock.Unlock()
+	old.CloseIdleConnections()
+}
+
+// A pooledTransport is an http.Transport that records statistics on how
+// often connections are reused.
+type pooledTransport struct {
+	lock      sync.RWMutex
+	transport *http.Transport
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&upstreamStats.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&upstreamStats.newConns, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	t.lock.RLock()
+	transport := t.transport
+	t.lock.RUnlock()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&upstreamStats.errors, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&upstreamStats.requests, 1)
+	if resp.ProtoMajor == 2 {
+		atomic.AddInt64(&upstreamStats.http2Requests, 1)
+	}
+	return resp, nil
+}
+
+// connectionStats holds counters for the connections opened by
+// httpTransport.
+type connectionStats struct {
+	requests      int64
+	http2Requests int64
+	errors        int64
+	newConns      int64
+	reusedConns   int64
+	dialed        int64
+	open          int64
+}
+
+var upstreamStats = new(connectionStats)
+
+// track counts conn as an open connection until it is closed.
+func (s *connectionStats) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&s.dialed, 1)
+	atomic.AddInt64(&s.open, 1)
+	return &trackedConn{Conn: conn, stats: s}
+}
+
+type trackedConn struct {
+	net.Conn
+	stats     *connectionStats
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.stats.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// handleConnectionStats reports the connection-reuse statistics for the
+// upstream connection pool.
+func handleConnectionStats(w http.ResponseWriter, r *http.Request) {
+	s := upstreamStats
+	newConns, reusedConns := atomic.LoadInt64(&s.newConns), atomic.LoadInt64(&s.reusedConns)
+	var reuseRate float64
+	if newConns+reusedConns > 0 {
+		reuseRate = float64(reusedConns) / float64(newConns+reusedConns)
+	}
+	ServeJSON(w, r, map[string]interface{}{
+		"requests":           atomic.LoadInt64(&s.requests),
+		"http2_requests":     atomic.LoadInt64(&s.http2Requests),
+		"errors":             atomic.LoadInt64(&s.errors),
+		"new_connections":    newConns,
+		"reused_connections": reusedConns,
+		"reuse_rate":         reuseRate,
+		"dialed":             atomic.LoadInt64(&s.dialed),
+		"open_connections":   atomic.LoadInt64(&s.open),
+	})
 }
 
 var http2Transport = &http2.Transport{}
 
-func dialWithExtraRootCerts(network, addr string) (net.Conn, error) {
+func dialWithExtraRootCertsContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	// Dial a TLS connection, and make sure it is valid against either the system default
 	// roots or conf.ExtraRootCerts.
 	serverName, _, _ := net.SplitHostPort(addr)
-	conn, err := tls.DialWithDialer(dialer, network, addr, &tls.Config{
+	conn, err := dialTLSPinned(ctx, dialer, network, addr, &tls.Config{
 		ServerName:         serverName,
 		InsecureSkipVerify: true,
 	})
@@ -76,7 +224,10 @@ func dialWithExtraRootCerts(network, addr string) (net.Conn, error) {
 }
 
 var transportWithExtraRootCerts = &http.Transport{
-	DialTLS:               dialWithExtraRootCerts,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialPinned(ctx, dialer, network, addr)
+	},
+	DialTLSContext:        dialWithExtraRootCertsContext,
 	TLSHandshakeTimeout:   10 * time.Second,
 	ExpectContinueTimeout: 1 * time.Second,
 }
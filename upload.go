@@ -0,0 +1,268 @@
+package main
+
+// Scanning request bodies (form submissions, JSON API calls, and file
+// uploads) for phrases and sensitive data, for the block-upload action.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// dataPatternPrefix is the prefix for data pattern rules in category lists.
+const dataPatternPrefix = "pattern:"
+
+// A dataPattern is a regular expression that identifies sensitive data,
+// configured with the data-pattern option.
+type dataPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// builtinDataPatterns are the data patterns that are always available. They
+// return the number of matches in the text.
+var builtinDataPatterns = map[string]func(text []byte) int{
+	"credit-card": countCreditCards,
+	"ssn":         countSSNs,
+}
+
+// addDataPattern parses the value of a data-pattern option: the pattern's
+// name, and a regular expression.
+func (conf *config) addDataPattern(s string) error {
+	name, expr, ok := strings.Cut(strings.TrimSpace(s), " ")
+	expr = strings.TrimSpace(expr)
+	if !ok || expr == "" {
+		return errors.New("data-pattern needs a name and a regular expression")
+	}
+	name = strings.ToLower(name)
+	if _, ok := builtinDataPatterns[name]; ok {
+		return fmt.Errorf("data-pattern %s is built in", name)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression for data-pattern %s: %v", name, err)
+	}
+	conf.DataPatterns = append(conf.DataPatterns, dataPattern{name, re})
+	return nil
+}
+
+// scansUploads returns whether a has any block-upload rules, which require
+// request bodies to be scanned.
+func (a *ACLDefinitions) scansUploads() bool {
+	for _, r := range a.Actions {
+		if r.Action == "block-upload" {
+			return true
+		}
+	}
+	return false
+}
+
+// scanUpload scans the body of r (up to MaxUploadScanSize bytes) for
+// content phrases and data patterns, and updates tally. It returns false if
+// there is no body to scan. The body is left ready to be read again.
+func (conf *config) scanUpload(r *http.Request, tally map[rule]int) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(conf.MaxUploadScanSize)))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) == 0 {
+		return false
+	}
+
+	text := uploadText(body, r.Header.Get("Content-Type"), conf.MaxUploadScanSize)
+	if len(text) == 0 {
+		return false
+	}
+
+	conf.scanContent(text, "text/plain", "utf-8", tally)
+
+	for name, count := range builtinDataPatterns {
+		if n := count(text); n > 0 {
+			tally[rule{t: dataPatternMatch, content: name}] += n
+		}
+	}
+	for _, p := range conf.DataPatterns {
+		if matches := p.re.FindAllIndex(text, -1); len(matches) > 0 {
+			tally[rule{t: dataPatternMatch, content: p.name}] += len(matches)
+		}
+	}
+	return true
+}
+
+// checkUpload changes req's action to block-upload if the phrases and data
+// patterns found in its body call for it. The upload's tally is kept
+// separate from the request's, so that it only affects block-upload rules.
+func (req *Request) checkUpload(tally map[rule]int) {
+	conf := getConfig()
+	scores := conf.categoryScores(tally)
+	ar, ignored := conf.ChooseACLCategoryAction(req.ACLs.data, scores, conf.Threshold, "allow", "block-upload")
+	if ar.Action == "block-upload" {
+		req.Action, req.Ignored = ar, ignored
+		req.UploadTally, req.UploadScores = tally, scores
+	}
+}
+
+// uploadText decodes an upload and returns the text it contains, with a
+// line for each form field or JSON string. Binary files that aren't
+// documents that text can be extracted from are skipped.
+func uploadText(body []byte, contentType string, maxLen int) []byte {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	var buf bytes.Buffer
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, _ := url.ParseQuery(string(body))
+		for _, v := range values {
+			for _, s := range v {
+				buf.WriteString(s)
+				buf.WriteByte('\n')
+			}
+		}
+
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			if part.FileName() != "" {
+				data = fileText(data, part.Header.Get("Content-Type"), maxLen)
+			}
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			// It may have been cut off at MaxUploadScanSize.
+			return fileText(body, "text/plain", maxLen)
+		}
+		writeJSONStrings(&buf, v)
+
+	default:
+		return fileText(body, contentType, maxLen)
+	}
+
+	return buf.Bytes()
+}
+
+// fileText returns the text from an uploaded file: the file itself if it is
+// text, or the text extracted from it if it is a document. Otherwise it
+// returns nil.
+func fileText(data []byte, contentType string, maxLen int) []byte {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if extract := documentExtractor(data, contentType); extract != nil {
+		return extract(data, maxLen)
+	}
+	if sniffFileType(data) == "" && utf8.Valid(data) {
+		return data
+	}
+	return nil
+}
+
+// writeJSONStrings writes the strings and numbers in a decoded JSON value to
+// buf, one per line. Object keys are included too, since they sometimes
+// contain data.
+func writeJSONStrings(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	case json.Number:
+		buf.WriteString(v.String())
+		buf.WriteByte('\n')
+	case []interface{}:
+		for _, e := range v {
+			writeJSONStrings(buf, e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			buf.WriteString(k)
+			buf.WriteByte('\n')
+			writeJSONStrings(buf, e)
+		}
+	}
+}
+
+var creditCardPattern = regexp.MustCompile(`\b[2-6]\d(?:[ -]?\d){11,17}\b`)
+
+// countCreditCards returns the number of credit card numbers in text: 13 to
+// 19 digits (optionally separated by spaces or hyphens), with a valid Luhn
+// check digit.
+func countCreditCards(text []byte) int {
+	n := 0
+	for _, m := range creditCardPattern.FindAll(text, -1) {
+		digits := make([]byte, 0, 19)
+		for _, c := range m {
+			if c >= '0' && c <= '9' {
+				digits = append(digits, c)
+			}
+		}
+		if len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits) {
+			n++
+		}
+	}
+	return n
+}
+
+// luhnValid returns whether the last digit of number is a valid Luhn check
+// digit.
+func luhnValid(number []byte) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+var ssnPattern = regexp.MustCompile(`\b(\d{3})([- ])(\d{2})([- ])(\d{4})\b`)
+
+// countSSNs returns the number of U.S. Social Security numbers in text. To
+// avoid matching other numbers, they must be written with separators
+// (123-45-6789 or 123 45 6789), and the numbers that are never assigned
+// are skipped.
+func countSSNs(text []byte) int {
+	n := 0
+	for _, m := range ssnPattern.FindAllSubmatch(text, -1) {
+		area, group, serial := string(m[1]), string(m[3]), string(m[5])
+		switch {
+		case !bytes.Equal(m[2], m[4]),
+			area == "000", area == "666", area[0] == '9',
+			group == "00",
+			serial == "0000":
+			continue
+		}
+		n++
+	}
+	return n
+}
@@ -33,21 +33,43 @@ func newRegexMap() *regexMap {
 }
 
 func (rm *regexMap) findMatches(s string, tally map[rule]int) {
+	rm.match(s, func(r regexRule) {
+		if r.MatchString(s) {
+			tally[r.rule] = 1
+		}
+	})
+}
+
+// countMatches is like findMatches, but it counts each match of the
+// regular expressions, instead of just recording which ones match.
+func (rm *regexMap) countMatches(s string, tally map[rule]int) {
+	rm.match(s, func(r regexRule) {
+		if n := len(r.FindAllStringIndex(s, -1)); n > 0 {
+			tally[r.rule] += n
+		}
+	})
+}
+
+// match calls f for each rule that could match s: the rules whose literal
+// strings occur in s, and the rules that have none. It calls f only once for
+// each rule.
+func (rm *regexMap) match(s string, f func(r regexRule)) {
 	if len(rm.rules) == 0 {
 		return
 	}
 
-	tried := map[string]bool{}
-	scanner := newPhraseScanner(rm.stringList, func(p string) {
-		if tried[p] {
-			return
+	tried := map[rule]bool{}
+	try := func(r regexRule) {
+		if !tried[r.rule] {
+			tried[r.rule] = true
+			f(r)
 		}
+	}
+
+	scanner := newPhraseScanner(rm.stringList, func(p string) {
 		for _, r := range rm.rules[p] {
-			if r.MatchString(s) {
-				tally[r.rule] = 1
-			}
+			try(r)
 		}
-		tried[p] = true
 	})
 
 	for i := 0; i < len(s); i++ {
@@ -56,9 +78,7 @@ func (rm *regexMap) findMatches(s string, tally map[rule]int) {
 
 	// Now try the regexes that have no distinctive literal string component.
 	for _, r := range rm.rules[""] {
-		if r.MatchString(s) {
-			tally[r.rule] = 1
-		}
+		try(r)
 	}
 }
 
@@ -68,7 +88,7 @@ func (rm *regexMap) addRule(r rule) {
 
 	re, err := regexp.Compile(s)
 	if err != nil {
-		log.Printf("Error parsing URL regular expression %s: %v", r, err)
+		log.Printf("Error parsing regular expression %s: %v", r, err)
 		return
 	}
 
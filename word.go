@@ -9,8 +9,8 @@ import (
 
 // wordRune maps c into a reduced set of "word" characters.
 // If c is a letter, it returns it in lowercase.
-// If it is a digit, it returns it unchanged.
-// Otherwise it returns a space.
+// If it is a digit or a combining mark (like the vowel signs in Thai), it
+// returns it unchanged. Otherwise it returns a space.
 func wordRune(c rune) rune {
 	switch {
 	case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
@@ -23,6 +23,8 @@ func wordRune(c rune) rune {
 		return c
 	case unicode.IsLetter(c):
 		return unicode.ToLower(c)
+	case unicode.IsMark(c):
+		return c
 	}
 
 	return ' '